@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	ErrNoCredentials  = errors.New("authentication required")
+	ErrBadCredentials = errors.New("invalid credentials")
+)
+
+// User is who a connection belongs to. Name is unique and stable; the
+// nickname shown in chat may differ per connection.
+type User struct {
+	Name string
+}
+
+// Authenticator checks the credentials of a WebSocket handshake. It returns
+// ErrNoCredentials when r carries none it understands, so authenticators can
+// be chained.
+type Authenticator interface {
+	Authenticate(r *http.Request) (User, error)
+}
+
+// UserDirectory is implemented by authenticators that know every user who
+// can log in, so direct messages to anyone else can be refused.
+type UserDirectory interface {
+	HasUser(name string) bool
+}
+
+// ChainAuthenticator asks each authenticator in turn and uses the first one
+// that found credentials it understands.
+type ChainAuthenticator []Authenticator
+
+func (c ChainAuthenticator) Authenticate(r *http.Request) (User, error) {
+	for _, a := range c {
+		user, err := a.Authenticate(r)
+		if !errors.Is(err, ErrNoCredentials) {
+			return user, err
+		}
+	}
+	return User{}, ErrNoCredentials
+}
+
+// HasUser reports whether any authenticator in the chain may let name in.
+// One that is not a UserDirectory may let anyone in.
+func (c ChainAuthenticator) HasUser(name string) bool {
+	for _, a := range c {
+		if dir, ok := a.(UserDirectory); !ok || dir.HasUser(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// GuestAuthenticator lets everyone in under a made up guest-N name. It is
+// what the server uses when no tokens or passwords are configured. Servers
+// sharing a broker need a Prefix each to keep their guests apart.
+type GuestAuthenticator struct {
+	Prefix string // defaults to "guest-"
+	guests atomic.Uint64
+}
+
+func (g *GuestAuthenticator) Authenticate(r *http.Request) (User, error) {
+	prefix := g.Prefix
+	if prefix == "" {
+		prefix = "guest-"
+	}
+	return User{Name: fmt.Sprintf("%s%d", prefix, g.guests.Add(1))}, nil
+}
+
+// TokenAuthenticator accepts "Authorization: Bearer TOKEN" or, for browsers
+// that cannot set headers on a WebSocket, ?token=TOKEN. Tokens are looked up
+// by their SHA-256 so lookups do not leak how much of a token matched.
+type TokenAuthenticator struct {
+	tokens map[[sha256.Size]byte]string
+	users  map[string]bool
+	folded map[string]bool // users by foldName
+}
+
+// LoadTokens reads "token username" lines; blank lines and lines starting
+// with '#' are ignored.
+func LoadTokens(path string) (*TokenAuthenticator, error) {
+	ta := &TokenAuthenticator{
+		tokens: make(map[[sha256.Size]byte]string),
+		users:  make(map[string]bool),
+		folded: make(map[string]bool),
+	}
+	err := readUserFile(path, func(line string) error {
+		token, name, ok := strings.Cut(line, " ")
+		name = strings.TrimSpace(name)
+		if !ok || !ValidUserName(name) {
+			return errors.New(`want "token username"`)
+		}
+		ta.tokens[sha256.Sum256([]byte(token))] = name
+		ta.users[name] = true
+		ta.folded[foldName(name)] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ta, nil
+}
+
+func (ta *TokenAuthenticator) Authenticate(r *http.Request) (User, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return User{}, ErrNoCredentials
+	}
+	name, ok := ta.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return User{}, ErrBadCredentials
+	}
+	return User{Name: name}, nil
+}
+
+func (ta *TokenAuthenticator) HasUser(name string) bool {
+	return ta.users[name]
+}
+
+func (ta *TokenAuthenticator) HasUserFold(name string) bool {
+	return ta.folded[foldName(name)]
+}
+
+const (
+	passwordIterations = 210000
+	passwordKeyLength  = 32
+)
+
+// PasswordAuthenticator checks HTTP basic credentials against password
+// hashes made by HashPassword.
+type PasswordAuthenticator struct {
+	users  map[string]string
+	folded map[string]bool // users by foldName
+}
+
+// LoadPasswords reads "username:hash" lines; blank lines and lines starting
+// with '#' are ignored.
+func LoadPasswords(path string) (*PasswordAuthenticator, error) {
+	pa := &PasswordAuthenticator{users: make(map[string]string), folded: make(map[string]bool)}
+	err := readUserFile(path, func(line string) error {
+		name, hash, ok := strings.Cut(line, ":")
+		if !ok || !ValidUserName(name) || !strings.HasPrefix(hash, "pbkdf2-sha256$") {
+			return errors.New(`want "username:pbkdf2-sha256$..."`)
+		}
+		pa.users[name] = hash
+		pa.folded[foldName(name)] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pa, nil
+}
+
+func (pa *PasswordAuthenticator) Authenticate(r *http.Request) (User, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return User{}, ErrNoCredentials
+	}
+	hash, known := pa.users[name]
+	if !known {
+		// Spend the same time as for a known user.
+		checkPassword("pbkdf2-sha256$"+strconv.Itoa(passwordIterations)+"$AAAAAAAAAAAAAAAAAAAAAA$", password)
+		return User{}, ErrBadCredentials
+	}
+	if !checkPassword(hash, password) {
+		return User{}, ErrBadCredentials
+	}
+	return User{Name: name}, nil
+}
+
+func (pa *PasswordAuthenticator) HasUser(name string) bool {
+	_, ok := pa.users[name]
+	return ok
+}
+
+func (pa *PasswordAuthenticator) HasUserFold(name string) bool {
+	return pa.folded[foldName(name)]
+}
+
+// HashPassword returns "pbkdf2-sha256$ITERATIONS$SALT$KEY" with a random salt.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeyLength)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, passwordKeyLength)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+func readUserFile(path string, parse func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parse(line); err != nil {
+			return fmt.Errorf("%s line %d: %w", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
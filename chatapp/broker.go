@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"sync"
+)
+
+// Broker carries messages between chat servers, so that several of them
+// behind a load balancer act as one. Every server publishes the room events
+// of its own clients and delivers those of the others to its clients.
+type Broker interface {
+	Publish(channel string, data []byte) error
+	// Subscribe returns the messages published on channel from now on, by
+	// this server as well as others. The channel is closed by Close.
+	Subscribe(channel string) (<-chan []byte, error)
+	Close() error
+}
+
+var errBrokerClosed = errors.New("broker is closed")
+
+// MemoryBroker connects servers running in one process. With a single
+// server it is a loopback.
+type MemoryBroker struct {
+	mu     sync.Mutex
+	subs   map[string][]chan []byte
+	closed bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subs: make(map[string][]chan []byte)}
+}
+
+func (b *MemoryBroker) Publish(channel string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errBrokerClosed
+	}
+	for _, sub := range b.subs[channel] {
+		sub <- data
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(channel string) (<-chan []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, errBrokerClosed
+	}
+	sub := make(chan []byte, 256)
+	b.subs[channel] = append(b.subs[channel], sub)
+	return sub, nil
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		for _, subs := range b.subs {
+			for _, sub := range subs {
+				close(sub)
+			}
+		}
+	}
+	return nil
+}
+
+// brokerEnvelope is what servers publish, along with the server it came
+// from, which skips its own since its clients already got them: a room event
+// or direct message in Msg, or news of the server's users (see peers.go).
+type brokerEnvelope struct {
+	Node     string        `json:"node"`
+	Msg      *Message      `json:"msg,omitempty"`
+	Online   string        `json:"online,omitempty"`  // the user opened or closed a connection and is still connected
+	Nicks    []string      `json:"nicks,omitempty"`   // with Online, the nicknames the user holds on the server
+	Offline  string        `json:"offline,omitempty"` // the user closed their last connection
+	Snapshot *nodeSnapshot `json:"snapshot,omitempty"`
+}
+
+var brokerDropped = expvar.NewInt("chat_broker_dropped")
+
+// ConnectBroker makes the server share room events, direct messages and
+// who is connected where with the other servers on channel of b. It must be
+// called before Run. A nickname held on one server is refused on the others.
+func (s *Server) ConnectBroker(b Broker, channel string) error {
+	sub, err := b.Subscribe(channel)
+	if err != nil {
+		return err
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	s.node = hex.EncodeToString(id[:])
+	s.outbox = make(chan []byte, 1024)
+
+	go func() {
+		for data := range s.outbox {
+			if err := b.Publish(channel, data); err != nil {
+				brokerDropped.Add(1)
+				log.Printf("Error publishing to broker: %v", err)
+			}
+		}
+	}()
+	go func() {
+		for data := range sub {
+			env := &brokerEnvelope{}
+			if err := json.Unmarshal(data, env); err != nil {
+				log.Printf("Error decoding broker message: %v", err)
+				continue
+			}
+			if env.Node != s.node {
+				s.remote <- env
+			}
+		}
+	}()
+	return nil
+}
+
+// publish hands a room event or direct message to the broker without
+// waiting for it. A broker that cannot keep up loses events rather than
+// stall the hub.
+func (s *Server) publish(msg *Message) {
+	s.publishEnvelope(&brokerEnvelope{Msg: msg})
+}
+
+func (s *Server) publishEnvelope(env *brokerEnvelope) {
+	if s.outbox == nil {
+		return
+	}
+	env.Node = s.node
+	data, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("Error encoding message for broker: %v", err)
+		return
+	}
+	select {
+	case s.outbox <- data:
+	default:
+		brokerDropped.Add(1)
+	}
+}
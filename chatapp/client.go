@@ -1,19 +1,37 @@
+//go:build client
+
+// The terminal client shares message.go with the server but has its own
+// main, so it is kept out of the server package by the client build tag and
+// built from its files: go build -o chatclient client*.go message.go
+
 package main
 
 import (
-	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 func main() {
 	serverAddr := flag.String("port", "localhost:8080", "server address")
+	token := flag.String("token", os.Getenv("CHAT_TOKEN"), "bearer token to log in with (default $CHAT_TOKEN)")
+	user := flag.String("user", "", "user name to log in with a password")
+	password := flag.String("password", "", "password for -user (default $CHAT_PASSWORD)")
+	nick := flag.String("nick", "", "nickname to chat under (default the user name)")
+	idleTimeout := flag.Duration("idle-timeout", 90*time.Second, "reconnect when nothing, server pings included, arrives for this long")
 	flag.Parse()
 
 	interrupt := make(chan os.Signal, 1)
@@ -21,57 +39,444 @@ func main() {
 
 	u := url.URL{
 		Scheme: "ws",
-		Host: *serverAddr,
-		Path: "/",
+		Host:   *serverAddr,
+		Path:   "/",
 	}
 	log.Printf("Connecting to %s", u.String())
 
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		log.Fatal("Error connecting to websocket server:", err)
+	header := make(http.Header)
+	switch {
+	case *user != "":
+		if *password == "" {
+			*password = os.Getenv("CHAT_PASSWORD")
+		}
+		req := http.Request{Header: header}
+		req.SetBasicAuth(*user, *password)
+	case *token != "":
+		header.Set("Authorization", "Bearer "+*token)
 	}
-	defer conn.Close()
-	log.Println("Connected to websocket server")
 
-	done := make(chan struct{})
+	st := &clientState{
+		room:     DefaultRoom,
+		seen:     &scrollback{oldest: make(map[string]string), newest: make(map[string]string)},
+		receipts: newReceipts(),
+		markers:  make(chan *Message, 64),
+		pages:    make(chan *Message, 16),
+	}
+	in := readInput()
+	defer in.restore()
+	retry := backoff{min: time.Second, max: 30 * time.Second}
+	fmt.Println("Type messages and press Enter to send (ctrl+c to quit, /help for commands):")
+
+	for {
+		// Resume DefaultRoom from the last message we saw in it.
+		query := url.Values{}
+		if *nick != "" {
+			query.Set("nick", *nick)
+		}
+		if after := st.seen.after(DefaultRoom); after != "" {
+			query.Set("after", after)
+		}
+		u.RawQuery = query.Encode()
+
+		conn, me, err := dial(u.String(), header)
+		if err != nil {
+			var refused *refusedError
+			if errors.As(err, &refused) {
+				in.restore()
+				log.Fatal("Error connecting to websocket server: ", err)
+			}
+			wait := retry.wait()
+			log.Printf("Error connecting to websocket server: %v; retrying in %s", err, wait.Round(100*time.Millisecond))
+			select {
+			case <-time.After(wait):
+				continue
+			case <-interrupt:
+				return
+			}
+		}
+		retry.reset()
+		st.receipts.setMe(me)
+		log.Printf("Connected to websocket server as %s", me)
+
+		// The server puts every new connection in DefaultRoom; get back into
+		// the room we were talking in, and what was said there meanwhile.
+		if st.room != "" && st.room != DefaultRoom {
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			conn.WriteJSON(&Message{Type: TypeJoin, Room: st.room, After: st.seen.after(st.room)})
+		}
+
+		done := make(chan struct{})
+		go readMessages(conn, done, st, *idleTimeout)
+		quit := writeMessages(conn, done, interrupt, in, st)
+		if quit {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			conn.Close()
+			return
+		}
+		conn.Close()
+		log.Println("Connection lost, reconnecting")
+	}
+}
+
+// clientState outlives connections; the reconnect loop hands it to each.
+type clientState struct {
+	room     string    // room plain lines go to; only touched by the writer
+	typed    time.Time // when the writer last sent a typing frame
+	seen     *scrollback
+	receipts *receipts
+	markers  chan *Message // delivered markers the reader queues for the writer
+	pages    chan *Message // history requests the reader queues for the writer
+}
+
+// scrollback remembers the oldest and newest message seen in each room. The
+// next /history request picks up at the oldest, a reconnect after the
+// newest.
+type scrollback struct {
+	mu     sync.Mutex
+	oldest map[string]string
+	newest map[string]string
+}
+
+// see records msg and returns what of it to show: nil for a message seen
+// already, which happens when a resumed connection overlaps the last one.
+func (sb *scrollback) see(msg *Message) *Message {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	switch msg.Type {
+	case TypeChat:
+		if msg.ID <= sb.newest[msg.Room] {
+			return nil
+		}
+		sb.newest[msg.Room] = msg.ID
+		if sb.oldest[msg.Room] == "" {
+			sb.oldest[msg.Room] = msg.ID
+		}
+	case TypeHistory:
+		if len(msg.Messages) == 0 {
+			return msg
+		}
+		if first := msg.Messages[0].ID; sb.oldest[msg.Room] == "" || first < sb.oldest[msg.Room] {
+			sb.oldest[msg.Room] = first
+		}
+		if msg.Before != "" {
+			// Scrollback is older than anything seen.
+			return msg
+		}
+		fresh := *msg
+		fresh.Messages = nil
+		for _, m := range msg.Messages {
+			if m.ID > sb.newest[msg.Room] {
+				fresh.Messages = append(fresh.Messages, m)
+				sb.newest[msg.Room] = m.ID
+			}
+		}
+		if len(fresh.Messages) == 0 {
+			return nil
+		}
+		return &fresh
+	}
+	return msg
+}
 
-	go readMessages(conn, done)
+func (sb *scrollback) after(room string) string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.newest[room]
+}
 
-	writeMessages(conn, done, interrupt)
+func (sb *scrollback) before(room string) string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.oldest[room]
 }
 
-func readMessages(conn *websocket.Conn, done chan struct{}) {
+// readMessages prints what the server sends until the connection fails or
+// stays silent for idleTimeout, then closes done.
+func readMessages(conn *websocket.Conn, done chan struct{}, st *clientState, idleTimeout time.Duration) {
 	defer close(done)
+	conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
 	for {
-		_, message, err := conn.ReadMessage()
+		_, data, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("Error reading from server:", err)
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("Error reading from server:", err)
+			}
 			return
 		}
-		fmt.Printf("< %s\n", message)
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Println("Error decoding message from server:", err)
+			continue
+		}
+		st.nextPage(&msg)
+		shown := st.seen.see(&msg)
+		if shown == nil {
+			continue
+		}
+
+		var line string
+		switch msg.Type {
+		case TypeAck:
+			st.receipts.sent(&msg)
+		case TypeDelivered, TypeRead:
+			line = st.receipts.format(&msg)
+		case TypeChat, TypeHistory:
+			st.confirmDelivery(shown)
+			line = formatMessage(shown)
+		default:
+			line = formatMessage(shown)
+		}
+		if line != "" {
+			fmt.Println(line)
+		}
+	}
+}
+
+// confirmDelivery queues a delivered marker for the newest message of
+// others in msg. Markers cover everything before them, so one that does not
+// fit in the queue can be skipped.
+func (st *clientState) confirmDelivery(msg *Message) {
+	last := msg
+	if msg.Type == TypeHistory {
+		if msg.Before != "" || len(msg.Messages) == 0 {
+			return
+		}
+		last = msg.Messages[len(msg.Messages)-1]
+	}
+	if last.ID == "" || st.receipts.fromMe(last) {
+		return
+	}
+	select {
+	case st.markers <- &Message{Type: TypeDelivered, Room: msg.Room, ID: last.ID}:
+	default:
+	}
+}
+
+// nextPage asks for the rest of a catch up that the server cut short. Only
+// one page of a room is asked for at a time, so the queue does not fill.
+func (st *clientState) nextPage(msg *Message) {
+	if msg.Type != TypeHistory || msg.After == "" || !msg.More || len(msg.Messages) == 0 {
+		return
+	}
+	last := msg.Messages[len(msg.Messages)-1]
+	select {
+	case st.pages <- &Message{Type: TypeHistory, Room: msg.Room, After: last.ID, Limit: MaxHistoryLimit}:
+	default:
+	}
+}
+
+// sender names who sent msg by nickname, adding the user name when the two
+// differ so a nickname cannot pass for someone else.
+func sender(msg *Message) string {
+	if msg.Nick == "" || msg.Nick == msg.From {
+		return msg.From
+	}
+	return fmt.Sprintf("%s (%s)", msg.Nick, msg.From)
+}
+
+func formatMessage(msg *Message) string {
+	ts := msg.Time.Local().Format("15:04")
+	switch msg.Type {
+	case TypeChat:
+		return fmt.Sprintf("%s [%s] %s: %s", ts, msg.Room, sender(msg), msg.Body)
+	case TypeDirect:
+		return fmt.Sprintf("%s [dm to %s] %s: %s", ts, msg.To, sender(msg), msg.Body)
+	case TypeJoin:
+		return fmt.Sprintf("%s * %s joined #%s", ts, sender(msg), msg.Room)
+	case TypeLeave:
+		return fmt.Sprintf("%s * %s left #%s", ts, sender(msg), msg.Room)
+	case TypeTyping:
+		return fmt.Sprintf("%s * %s is typing in #%s", ts, sender(msg), msg.Room)
+	case TypeRooms:
+		if len(msg.Rooms) == 0 {
+			return "No rooms"
+		}
+		names := make([]string, len(msg.Rooms))
+		for i, room := range msg.Rooms {
+			names[i] = fmt.Sprintf("#%s (%d)", room.Name, room.Members)
+		}
+		return "Rooms: " + strings.Join(names, ", ")
+	case TypeWho:
+		names := make([]string, len(msg.Users))
+		for i, user := range msg.Users {
+			names[i] = user.Name
+			if len(user.Nicks) > 1 || len(user.Nicks) == 1 && user.Nicks[0] != user.Name {
+				names[i] += " (" + strings.Join(user.Nicks, ", ") + ")"
+			}
+		}
+		return fmt.Sprintf("In #%s: %s", msg.Room, strings.Join(names, ", "))
+	case TypeHistory:
+		if len(msg.Messages) == 0 {
+			if msg.Before == "" {
+				return ""
+			}
+			return fmt.Sprintf("No earlier messages in #%s", msg.Room)
+		}
+		lines := make([]string, len(msg.Messages))
+		for i, m := range msg.Messages {
+			lines[i] = formatMessage(m)
+		}
+		return fmt.Sprintf("--- history of #%s ---\n%s\n---", msg.Room, strings.Join(lines, "\n"))
+	case TypeError:
+		return fmt.Sprintf("! %s", msg.Body)
+	default:
+		// Acks need no output.
+		return ""
 	}
 }
 
-func writeMessages(conn *websocket.Conn, done chan struct{}, interrupt chan os.Signal) {
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Println("Type messages and press Enter to send (ctrl+c to quit):")
+const writeWait = 10 * time.Second
+
+// typingEvery is how often typing frames are sent while the user types; the
+// server relays them no more often anyway.
+const typingEvery = 3 * time.Second
 
+// writeMessages sends what the user types until the connection is lost,
+// which returns false, or the user quits, which returns true.
+func writeMessages(conn *websocket.Conn, done chan struct{}, interrupt chan os.Signal, in *input, st *clientState) bool {
+	send := func(msg *Message) bool {
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := conn.WriteJSON(msg); err != nil {
+			log.Println("Error writing to server:", err)
+			return false
+		}
+		return true
+	}
 	for {
 		select {
-		case <- done:
-			return
-		case <- interrupt:
+		case <-done:
+			return false
+		case <-interrupt:
 			log.Println("Interrupt Received. Closing connection")
-			return
-		default:
-			if scanner.Scan() {
-				message := scanner.Text()
-				err := conn.WriteMessage(websocket.TextMessage, []byte(message))
-				if err != nil {
-					log.Println("Error writing to server:", err)
-					return
+			return true
+		case marker := <-st.markers:
+			if !send(marker) {
+				return false
+			}
+		case page := <-st.pages:
+			if !send(page) {
+				return false
+			}
+		case <-in.typing:
+			if st.room != "" && time.Since(st.typed) >= typingEvery {
+				st.typed = time.Now()
+				if !send(&Message{Type: TypeTyping, Room: st.room}) {
+					return false
+				}
+			}
+		case line, ok := <-in.lines:
+			if !ok {
+				return true
+			}
+			// Typing in a room means having read it.
+			if st.room != "" {
+				if marker := st.receipts.readMarker(st.room, st.seen.after(st.room)); marker != nil && !send(marker) {
+					return false
 				}
 			}
+			msg := parseInput(line, &st.room, st.seen)
+			if msg != nil && !send(msg) {
+				return false
+			}
 		}
 	}
-}
\ No newline at end of file
+}
+
+const commandHelp = `Commands:
+  /join ROOM     join ROOM and talk in it
+  /leave [ROOM]  leave ROOM, or the room you are talking in
+  /msg USER TEXT send TEXT to USER only
+  /rooms         list rooms
+  /who [ROOM]    list who is in ROOM, or the room you are talking in
+  /history [N]   show N earlier messages of the room you are talking in
+  /help          show this help`
+
+// parseInput turns a line typed by the user into the frame to send, or nil
+// when there is nothing to send. room is the room plain lines go to; /join
+// and /leave move it. seen says where /history continues from.
+func parseInput(line string, room *string, seen *scrollback) *Message {
+	if !strings.HasPrefix(line, "/") {
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
+		if *room == "" {
+			fmt.Println("You are not talking in any room, /join one first")
+			return nil
+		}
+		return &Message{Type: TypeChat, Room: *room, Body: line}
+	}
+
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if cmd == "/msg" {
+		to, text, _ := strings.Cut(strings.TrimSpace(arg), " ")
+		if !ValidUserName(to) || strings.TrimSpace(text) == "" {
+			fmt.Println("Usage: /msg USER TEXT")
+			return nil
+		}
+		return &Message{Type: TypeDirect, To: to, Body: text}
+	}
+	arg = strings.ToLower(strings.TrimSpace(arg))
+	switch cmd {
+	case "/history":
+		if *room == "" {
+			fmt.Println("You are not talking in any room, /join one first")
+			return nil
+		}
+		limit := DefaultHistoryLimit
+		if arg != "" {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > MaxHistoryLimit {
+				fmt.Printf("Usage: /history [N] (N from 1 to %d)\n", MaxHistoryLimit)
+				return nil
+			}
+			limit = n
+		}
+		return &Message{Type: TypeHistory, Room: *room, Before: seen.before(*room), Limit: limit}
+	case "/join":
+		if !ValidRoomName(arg) {
+			fmt.Println("Usage: /join ROOM (a-z, 0-9, - and _)")
+			return nil
+		}
+		*room = arg
+		return &Message{Type: TypeJoin, Room: arg}
+	case "/leave":
+		if arg == "" {
+			arg = *room
+		}
+		if arg == "" {
+			fmt.Println("Usage: /leave ROOM")
+			return nil
+		}
+		if arg == *room {
+			*room = ""
+		}
+		return &Message{Type: TypeLeave, Room: arg}
+	case "/rooms":
+		return &Message{Type: TypeRooms}
+	case "/who":
+		if arg == "" {
+			arg = *room
+		}
+		if !ValidRoomName(arg) {
+			fmt.Println("Usage: /who ROOM")
+			return nil
+		}
+		return &Message{Type: TypeWho, Room: arg}
+	case "/help":
+		fmt.Println(commandHelp)
+		return nil
+	default:
+		fmt.Printf("Unknown command %s\n%s\n", cmd, commandHelp)
+		return nil
+	}
+}
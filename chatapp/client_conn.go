@@ -0,0 +1,60 @@
+//go:build client
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// refusedError is a handshake the server answered with a 4xx status, such
+// as bad credentials or a taken nickname. Trying again will not help.
+type refusedError struct {
+	status string
+	reason string
+}
+
+func (e *refusedError) Error() string {
+	return fmt.Sprintf("%s: %s", e.status, e.reason)
+}
+
+// dial connects to the server and returns the user name it logged us in as.
+func dial(u string, header http.Header) (*websocket.Conn, string, error) {
+	conn, resp, err := websocket.DefaultDialer.Dial(u, header)
+	if err != nil {
+		if resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			// The server explains a refused handshake in the body.
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return nil, "", &refusedError{status: resp.Status, reason: strings.TrimSpace(string(body))}
+		}
+		return nil, "", err
+	}
+	return conn, resp.Header.Get("X-Chat-User"), nil
+}
+
+// backoff doubles the wait between reconnection attempts from min up to
+// max. Each wait is jittered by up to a quarter so clients dropped by the
+// same server restart do not all come back at once.
+type backoff struct {
+	min, max time.Duration
+	next     time.Duration
+}
+
+func (b *backoff) wait() time.Duration {
+	if b.next < b.min {
+		b.next = b.min
+	}
+	d := b.next
+	b.next = min(2*b.next, b.max)
+	return d - time.Duration(rand.Int64N(int64(d)/4+1))
+}
+
+func (b *backoff) reset() {
+	b.next = b.min
+}
@@ -0,0 +1,99 @@
+//go:build client
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode"
+)
+
+// input reads what the user types in the background, so typed lines outlive
+// a connection. On a terminal it turns off line buffering with stty and
+// does the echo and editing (backspace, ctrl+u, ctrl+d) itself, to tell when
+// the user is typing a message. Elsewhere it reads whole lines and never
+// reports typing.
+type input struct {
+	lines  chan string   // closed at end of input
+	typing chan struct{} // a key of a message, not a command, was pressed
+	saved  string        // stty settings to restore, empty if untouched
+}
+
+func readInput() *input {
+	in := &input{lines: make(chan string), typing: make(chan struct{}, 1)}
+	if saved, err := stty("-g"); err == nil {
+		if _, err := stty("-icanon", "-echo", "min", "1"); err == nil {
+			in.saved = strings.TrimSpace(saved)
+		}
+	}
+	go func() {
+		defer close(in.lines)
+		if in.saved != "" {
+			in.readKeys()
+			return
+		}
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			in.lines <- scanner.Text()
+		}
+	}()
+	return in
+}
+
+// restore puts the terminal back the way it was.
+func (in *input) restore() {
+	if in.saved != "" {
+		stty(in.saved)
+	}
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+func (in *input) readKeys() {
+	r := bufio.NewReader(os.Stdin)
+	var line []rune
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return
+		}
+		switch c {
+		case '\r', '\n':
+			fmt.Println()
+			in.lines <- string(line)
+			line = line[:0]
+		case 0x7f, '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				fmt.Print("\b \b")
+			}
+		case 0x15: // ctrl+u
+			fmt.Print(strings.Repeat("\b \b", len(line)))
+			line = line[:0]
+		case 0x04: // ctrl+d
+			if len(line) == 0 {
+				return
+			}
+		default:
+			if unicode.IsControl(c) {
+				continue
+			}
+			line = append(line, c)
+			fmt.Print(string(c))
+			if line[0] != '/' {
+				select {
+				case in.typing <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+//go:build client
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// receipts shows the delivered and read receipts for the last message we
+// sent to each room, each user's strongest one once, and remembers which
+// read markers we sent.
+type receipts struct {
+	mu       sync.Mutex
+	me       string                            // our user name, as the server told us
+	lastOwn  map[string]string                 // room: ID of our last message
+	shown    map[string]map[string]MessageType // room: user: receipt shown for lastOwn
+	readSent map[string]string                 // room: last read marker sent
+}
+
+func newReceipts() *receipts {
+	return &receipts{
+		lastOwn:  make(map[string]string),
+		shown:    make(map[string]map[string]MessageType),
+		readSent: make(map[string]string),
+	}
+}
+
+func (rc *receipts) setMe(name string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.me = name
+}
+
+// fromMe reports whether we sent msg, from this connection or another one.
+func (rc *receipts) fromMe(msg *Message) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return msg.From == rc.me
+}
+
+// sent records the ack of a message we sent to a room.
+func (rc *receipts) sent(ack *Message) {
+	if ack.Room == "" {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.lastOwn[ack.Room] = ack.ID
+	delete(rc.shown, ack.Room)
+}
+
+// format returns the line to show for a receipt, or "" when it says nothing
+// new about our last message.
+func (rc *receipts) format(msg *Message) string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	own := rc.lastOwn[msg.Room]
+	if msg.From == rc.me || own == "" || msg.ID < own {
+		return ""
+	}
+	shown, ok := rc.shown[msg.Room]
+	if !ok {
+		shown = make(map[string]MessageType)
+		rc.shown[msg.Room] = shown
+	}
+	if shown[msg.From] == TypeRead || shown[msg.From] == msg.Type {
+		return ""
+	}
+	shown[msg.From] = msg.Type
+	if msg.Type == TypeRead {
+		return fmt.Sprintf("  ✓ read by %s", msg.From)
+	}
+	return fmt.Sprintf("  ✓ delivered to %s", msg.From)
+}
+
+// readMarker returns the read marker to send for room, up to the newest
+// message seen in it, or nil when it was sent already.
+func (rc *receipts) readMarker(room, newest string) *Message {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if newest == "" || newest <= rc.readSent[room] {
+		return nil
+	}
+	rc.readSent[room] = newest
+	return &Message{Type: TypeRead, Room: room, ID: newest}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// sendDirect delivers a direct message to every connection of its
+// recipient, on this server and through the broker on the others, or to the
+// mailbox when they are offline everywhere. The sender's other connections
+// get a copy so a conversation reads the same on all of them. Only users the
+// authenticator knows by name get mail: guest names are never handed out
+// again, so mail for an offline guest would wait forever. It must only be
+// called from Run.
+func (s *Server) sendDirect(client *Client, msg *Message) {
+	if dir, ok := s.auth.(UserDirectory); ok && !dir.HasUser(msg.To) {
+		client.deliver(errorEvent(msg.Ref, frameErrorf(CodeUnknownUser, "there is no user %s", msg.To)))
+		return
+	}
+	online := len(s.users[msg.To]) > 0 || s.onlineElsewhere(msg.To)
+	if !online && !registeredUser(s.auth, msg.To) {
+		client.deliver(errorEvent(msg.Ref, frameErrorf(CodeUnknownUser, "%s is not online", msg.To)))
+		return
+	}
+
+	dm := &Message{Type: TypeDirect, ID: newMessageID(), From: client.user.Name, Nick: client.nick, To: msg.To, Time: time.Now().UTC(), Body: msg.Body}
+	sent := func() {
+		s.deliverDirect(dm, client)
+		s.publish(dm)
+		s.answer(client, &Message{Type: TypeAck, ID: dm.ID, Ref: msg.Ref, To: msg.To, Time: dm.Time})
+	}
+	if online {
+		sent()
+		return
+	}
+	s.queueStore(&storeJob{do: func() error { return s.mailbox.Put(dm) }, done: func(err error) {
+		if err != nil {
+			var fe *FrameError
+			if !errors.As(err, &fe) {
+				log.Printf("Error storing message for %s: %v", msg.To, err)
+				err = errors.New("the message could not be stored for later delivery")
+			}
+			s.answer(client, errorEvent(msg.Ref, err))
+			return
+		}
+		sent()
+	}})
+}
+
+// deliverDirect hands dm to the recipient's connections on this server and
+// to the sender's, except skip. It must only be called from Run.
+func (s *Server) deliverDirect(dm *Message, skip *Client) {
+	data := encodeMessage(dm)
+	if data == nil {
+		return
+	}
+	for c := range s.users[dm.To] {
+		c.push(data)
+	}
+	if dm.From == dm.To {
+		return
+	}
+	for c := range s.users[dm.From] {
+		if c != skip {
+			c.push(data)
+		}
+	}
+}
+
+// deliverPending hands a connecting client the direct messages that arrived
+// while its user was offline. Should the client be gone by the time they
+// are read, they go back in the mailbox. It must only be called from Run.
+func (s *Server) deliverPending(client *Client) {
+	user := client.user.Name
+	var msgs []*Message
+	take := func() (err error) {
+		msgs, err = s.mailbox.Take(user)
+		return err
+	}
+	s.queueStore(&storeJob{do: take, done: func(err error) {
+		if err != nil {
+			log.Printf("Error reading messages for %s: %v", user, err)
+			return
+		}
+		if !s.clients[client] {
+			s.queueStore(&storeJob{do: func() error { return putBack(s.mailbox, msgs) }, done: func(err error) {
+				if err != nil {
+					log.Printf("Error storing messages for %s again: %v", user, err)
+				}
+			}})
+			return
+		}
+		for _, msg := range msgs {
+			client.deliver(msg)
+		}
+	}})
+}
+
+func putBack(mailbox Mailbox, msgs []*Message) error {
+	for _, msg := range msgs {
+		if err := mailbox.Put(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
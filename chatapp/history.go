@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// HistoryStore keeps the chat messages sent to each room, in ID order, so
+// "older than" is a comparison of IDs. Messages relayed by the broker may
+// come a little out of order or, from a server sharing the database, be
+// stored already.
+type HistoryStore interface {
+	// Append stores msgs, which may be of several rooms, at once: a store
+	// that syncs to disk or commits a transaction does so once for all.
+	Append(msgs ...*Message) error
+	// Before returns up to limit messages of room older than the message
+	// with ID before, or the latest ones when before is empty. They are
+	// returned oldest first.
+	Before(room, before string, limit int) ([]*Message, error)
+	// After returns up to limit messages of room newer than the message
+	// with ID after, oldest first.
+	After(room, after string, limit int) ([]*Message, error)
+	Close() error
+}
+
+// MemoryHistory keeps the last size messages of each room in a ring.
+type MemoryHistory struct {
+	mu    sync.Mutex
+	size  int
+	rooms map[string]*ring
+}
+
+type ring struct {
+	msgs  []*Message
+	start int // index of the oldest message once msgs is full
+}
+
+func NewMemoryHistory(size int) *MemoryHistory {
+	return &MemoryHistory{size: size, rooms: make(map[string]*ring)}
+}
+
+func (h *MemoryHistory) Append(msgs ...*Message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, msg := range msgs {
+		h.append(msg)
+	}
+	return nil
+}
+
+func (h *MemoryHistory) append(msg *Message) {
+	r, ok := h.rooms[msg.Room]
+	if !ok {
+		r = &ring{}
+		h.rooms[msg.Room] = r
+	}
+	n := len(r.msgs)
+	if n > 0 && msg.ID <= r.msgs[(r.start+n-1)%n].ID {
+		r.insert(msg, h.size)
+		return
+	}
+	if n < h.size {
+		r.msgs = append(r.msgs, msg)
+		return
+	}
+	r.msgs[r.start] = msg
+	r.start = (r.start + 1) % n
+}
+
+// insert puts msg, which is not the newest, in its place in r.
+func (r *ring) insert(msg *Message, size int) {
+	msgs := append(r.msgs[r.start:len(r.msgs):len(r.msgs)], r.msgs[:r.start]...)
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].ID >= msg.ID })
+	if msgs[i].ID == msg.ID {
+		return
+	}
+	msgs = slices.Insert(msgs, i, msg)
+	if len(msgs) > size {
+		msgs = msgs[1:]
+	}
+	r.msgs, r.start = msgs, 0
+}
+
+func (h *MemoryHistory) Before(room, before string, limit int) ([]*Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.rooms[room]
+	if !ok {
+		return nil, nil
+	}
+	n := len(r.msgs)
+	at := func(i int) *Message { return r.msgs[(r.start+i)%n] }
+	end := n
+	if before != "" {
+		end = sort.Search(n, func(i int) bool { return at(i).ID >= before })
+	}
+	begin := max(end-limit, 0)
+	msgs := make([]*Message, 0, end-begin)
+	for i := begin; i < end; i++ {
+		msgs = append(msgs, at(i))
+	}
+	return msgs, nil
+}
+
+func (h *MemoryHistory) After(room, after string, limit int) ([]*Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.rooms[room]
+	if !ok {
+		return nil, nil
+	}
+	n := len(r.msgs)
+	at := func(i int) *Message { return r.msgs[(r.start+i)%n] }
+	begin := sort.Search(n, func(i int) bool { return at(i).ID > after })
+	end := min(begin+limit, n)
+	msgs := make([]*Message, 0, end-begin)
+	for i := begin; i < end; i++ {
+		msgs = append(msgs, at(i))
+	}
+	return msgs, nil
+}
+
+func (h *MemoryHistory) Close() error {
+	return nil
+}
+
+// FileHistory appends every message to a file, one JSON object per line,
+// and answers reads from a MemoryHistory loaded from the file on start. The
+// file keeps everything; scrollback reaches back size messages per room.
+type FileHistory struct {
+	*MemoryHistory
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileHistory(path string, size int) (*FileHistory, error) {
+	mem := NewMemoryHistory(size)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = replayLog(f, path, func(msg *Message) error {
+		mem.Append(msg)
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileHistory{MemoryHistory: mem, file: f}, nil
+}
+
+// replayLog decodes each line of the log file f as a T and passes it to
+// apply. A last line that does not decode or lacks its newline is what a
+// crash in the middle of a write leaves behind: it is logged and cut off, so
+// the next record starts on a line of its own. A bad line anywhere else is an
+// error.
+func replayLog[T any](f *os.File, path string, apply func(rec *T) error) error {
+	r := bufio.NewReader(f)
+	var offset int64 // where the current line starts
+	for n := 1; ; n++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		rec := new(T)
+		bad := json.Unmarshal(data, rec)
+		if bad == nil && err == io.EOF {
+			bad = io.ErrUnexpectedEOF
+		}
+		if bad != nil {
+			if _, err := r.Peek(1); err != io.EOF {
+				return fmt.Errorf("%s line %d: %w", path, n, bad)
+			}
+			log.Printf("Dropping torn last line %d of %s: %v", n, path, bad)
+			if err := f.Truncate(offset); err != nil {
+				return fmt.Errorf("truncate %s: %w", path, err)
+			}
+			return nil
+		}
+		if err := apply(rec); err != nil {
+			return fmt.Errorf("%s line %d: %w", path, n, err)
+		}
+		offset += int64(len(data))
+	}
+}
+
+func (h *FileHistory) Append(msgs ...*Message) error {
+	var data []byte
+	for _, msg := range msgs {
+		line, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.file.Write(data); err != nil {
+		return err
+	}
+	// The ack tells the sender the message is stored, which it is not
+	// while it sits in the page cache.
+	if err := h.file.Sync(); err != nil {
+		return err
+	}
+	return h.MemoryHistory.Append(msgs...)
+}
+
+func (h *FileHistory) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.file.Close()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileHistoryDropsTornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	good := `{"type":"chat","id":"1","room":"general","from":"alice","body":"one"}` + "\n" +
+		`{"type":"chat","id":"2","room":"general","from":"alice","body":"two"}` + "\n"
+	if err := os.WriteFile(path, []byte(good+`{"type":"chat","id":"3","ro`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewFileHistory(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Append(&Message{Type: TypeChat, ID: "4", Room: "general", From: "bob", Body: "four"}); err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	h, err = NewFileHistory(path, 100)
+	if err != nil {
+		t.Fatalf("reopen after a torn line: %v", err)
+	}
+	defer h.Close()
+	msgs, err := h.Before("general", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	if len(ids) != 3 || ids[0] != "1" || ids[1] != "2" || ids[2] != "4" {
+		t.Errorf("got messages %v, want [1 2 4]", ids)
+	}
+}
+
+func TestFileHistoryRefusesCorruptLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	data := `{"type":"chat","id":"1","room":"general","from":"alice","body":"one"}` + "\n" +
+		"garbage\n" +
+		`{"type":"chat","id":"2","room":"general","from":"alice","body":"two"}` + "\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := NewFileHistory(path, 100); err == nil {
+		h.Close()
+		t.Fatal("a corrupt line in the middle of the file was accepted")
+	}
+}
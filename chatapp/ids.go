@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+var (
+	lastIDTime int64
+	idMu       sync.Mutex
+)
+
+// newMessageID returns a 24 hex digit ID: 8 bytes of Unix nanoseconds and 4
+// random bytes. IDs sort by the time they were handed out, which history
+// paging relies on, and the random part keeps IDs from separate processes
+// apart.
+func newMessageID() string {
+	idMu.Lock()
+	now := time.Now().UnixNano()
+	if now <= lastIDTime {
+		now = lastIDTime + 1
+	}
+	lastIDTime = now
+	idMu.Unlock()
+
+	var b [12]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(now))
+	rand.Read(b[8:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// MaxPending is how many direct messages wait for an offline user before
+// more are refused.
+const MaxPending = 100
+
+var ErrMailboxFull = &FrameError{Code: CodeMailboxFull, Reason: "the recipient has too many unread messages"}
+
+// Mailbox holds direct messages for users who are offline until they
+// connect again.
+type Mailbox interface {
+	// Put stores msg for msg.To. It returns ErrMailboxFull when MaxPending
+	// messages already wait.
+	Put(msg *Message) error
+	// Take removes and returns the messages waiting for user, oldest first.
+	Take(user string) ([]*Message, error)
+	Close() error
+}
+
+type MemoryMailbox struct {
+	mu      sync.Mutex
+	pending map[string][]*Message
+}
+
+func NewMemoryMailbox() *MemoryMailbox {
+	return &MemoryMailbox{pending: make(map[string][]*Message)}
+}
+
+func (m *MemoryMailbox) Put(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pending[msg.To]) >= MaxPending {
+		return ErrMailboxFull
+	}
+	m.pending[msg.To] = append(m.pending[msg.To], msg)
+	return nil
+}
+
+func (m *MemoryMailbox) Take(user string) ([]*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msgs := m.pending[user]
+	delete(m.pending, user)
+	return msgs, nil
+}
+
+func (m *MemoryMailbox) Close() error {
+	return nil
+}
+
+// mailboxRecord is a line of the FileMailbox log: "put" carries the message,
+// "take" the user whose messages were handed out.
+type mailboxRecord struct {
+	Op   string   `json:"op"`
+	Msg  *Message `json:"msg,omitempty"`
+	User string   `json:"user,omitempty"`
+}
+
+// FileMailbox keeps a MemoryMailbox and appends every change to a log file
+// that is replayed on start, so waiting messages survive restarts.
+type FileMailbox struct {
+	mem  *MemoryMailbox
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileMailbox(path string) (*FileMailbox, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	mem := NewMemoryMailbox()
+
+	err = replayLog(f, path, func(rec *mailboxRecord) error {
+		switch {
+		case rec.Op == "put" && rec.Msg != nil:
+			// A full mailbox was refused when it was written, so
+			// ErrMailboxFull cannot happen here.
+			mem.Put(rec.Msg)
+		case rec.Op == "take":
+			mem.Take(rec.User)
+		default:
+			return fmt.Errorf("unknown record %q", rec.Op)
+		}
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileMailbox{mem: mem, file: f}, nil
+}
+
+func (m *FileMailbox) Put(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.mem.Put(msg); err != nil {
+		return err
+	}
+	return m.write(&mailboxRecord{Op: "put", Msg: msg})
+}
+
+func (m *FileMailbox) Take(user string) ([]*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msgs, _ := m.mem.Take(user)
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	return msgs, m.write(&mailboxRecord{Op: "take", User: user})
+}
+
+func (m *FileMailbox) write(rec *mailboxRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := m.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return m.file.Sync()
+}
+
+func (m *FileMailbox) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.file.Close()
+}
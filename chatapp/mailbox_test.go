@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileMailboxDropsTornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mailbox")
+	good := `{"op":"put","msg":{"type":"dm","id":"1","to":"bob","from":"alice","body":"one"}}` + "\n"
+	if err := os.WriteFile(path, []byte(good+`{"op":"put","msg":{"type":"dm","id":"2","to`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewFileMailbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Put(&Message{Type: TypeDirect, ID: "3", To: "bob", From: "alice", Body: "three"}); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	m, err = NewFileMailbox(path)
+	if err != nil {
+		t.Fatalf("reopen after a torn line: %v", err)
+	}
+	defer m.Close()
+	msgs, err := m.Take("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].ID != "1" || msgs[1].ID != "3" {
+		t.Errorf("got %d messages, want 1 and 3", len(msgs))
+	}
+}
+
+func TestFileMailboxRefusesCorruptLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mailbox")
+	data := `{"op":"put","msg":{"type":"dm","id":"1","to":"bob","from":"alice","body":"one"}}` + "\n" +
+		`{"op":"lose"}` + "\n" +
+		`{"op":"take","user":"bob"}` + "\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := NewFileMailbox(path); err == nil {
+		m.Close()
+		t.Fatal("an unknown record in the middle of the file was accepted")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MessageType says what a Message frame is about. Every frame on the
+// WebSocket, in either direction, is one JSON encoded Message.
+type MessageType string
+
+const (
+	TypeChat      MessageType = "chat"      // a message to a room
+	TypeJoin      MessageType = "join"      // join a room, catching up from After; echoed to the room when someone joined
+	TypeLeave     MessageType = "leave"     // leave a room; echoed to the room when someone left
+	TypeRooms     MessageType = "rooms"     // ask for the room list; answered with Rooms set
+	TypeTyping    MessageType = "typing"    // the sender is typing in a room; relayed at most every few seconds
+	TypeWho       MessageType = "who"       // ask who is in a room; answered with Users set
+	TypeHistory   MessageType = "history"   // ask for the messages of a room before Before or after After; answered with Messages set
+	TypeDirect    MessageType = "dm"        // a private message to the user To
+	TypeAck       MessageType = "ack"       // the server stored the frame with Ref under ID
+	TypeDelivered MessageType = "delivered" // the sender received the messages of a room up to ID
+	TypeRead      MessageType = "read"      // the sender read the messages of a room up to ID
+	TypeError     MessageType = "error"     // the frame with Ref was rejected, Code and Body say why
+)
+
+// DefaultRoom is joined by every connection when it is opened. A connection
+// opened with ?after=ID gets the messages of DefaultRoom after ID instead of
+// the latest ones, which is how a client resumes after reconnecting.
+const DefaultRoom = "general"
+
+const (
+	maxBodyLength     = 4096
+	maxRefLength      = 64
+	maxRoomNameLength = 32
+	maxNickLength     = 24
+
+	// DefaultHistoryLimit messages are sent for a history request without
+	// Limit, and no more than MaxHistoryLimit for any.
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 200
+)
+
+// Message is the envelope of the chat protocol. Clients fill in Type, Room,
+// To, Body, ID, Before, After and Limit as the type needs, and optionally
+// Ref, an ID of their own that the server's ack or error echoes back. ID,
+// From, Nick and Time are set by the server: From is the sender's user name
+// and Nick the nickname they connected with. A history answer cut short by
+// Limit has More set; the next page is asked for from its last message, or
+// its first when going back.
+type Message struct {
+	Type  MessageType `json:"type"`
+	ID    string      `json:"id,omitempty"`
+	Ref   string      `json:"ref,omitempty"`
+	Room  string      `json:"room,omitempty"`
+	To    string      `json:"to,omitempty"`
+	From  string      `json:"from,omitempty"`
+	Nick  string      `json:"nick,omitempty"`
+	Time  time.Time   `json:"ts,omitzero"`
+	Body  string      `json:"body,omitempty"`
+	Code  string      `json:"code,omitempty"`
+	Rooms []RoomInfo  `json:"rooms,omitempty"`
+	Users []UserInfo  `json:"users,omitempty"`
+
+	Before   string     `json:"before,omitempty"`
+	After    string     `json:"after,omitempty"`
+	Limit    int        `json:"limit,omitempty"`
+	Messages []*Message `json:"messages,omitempty"`
+	More     bool       `json:"more,omitempty"`
+}
+
+// RoomInfo counts the users in a room, not their connections.
+type RoomInfo struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+}
+
+// UserInfo is a user in a room and the nicknames their connections use.
+type UserInfo struct {
+	Name  string   `json:"name"`
+	Nicks []string `json:"nicks"`
+}
+
+// Error codes sent in error frames.
+const (
+	CodeBadFrame  = "bad_frame"
+	CodeBadRoom   = "bad_room"
+	CodeNotMember = "not_member"
+
+	CodeUnknownUser = "unknown_user"
+	CodeMailboxFull = "mailbox_full"
+	CodeNotStored   = "not_stored"
+)
+
+// FrameError is a rejected frame; Code goes into the error event.
+type FrameError struct {
+	Code   string
+	Reason string
+}
+
+func (e *FrameError) Error() string {
+	return e.Reason
+}
+
+func frameErrorf(code, format string, args ...any) error {
+	return &FrameError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// ParseMessage decodes and checks a frame sent by a client. A frame that
+// decodes but fails the checks is returned along with the error, so the
+// error event can carry its Ref.
+func ParseMessage(data []byte) (*Message, error) {
+	var msg Message
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&msg); err != nil {
+		return nil, frameErrorf(CodeBadFrame, "frame is not a valid message: %v", err)
+	}
+	if dec.More() {
+		return nil, frameErrorf(CodeBadFrame, "frame must hold a single message")
+	}
+	if err := msg.validate(); err != nil {
+		return &msg, err
+	}
+	return &msg, nil
+}
+
+func (m *Message) validate() error {
+	if len(m.Ref) > maxRefLength {
+		return frameErrorf(CodeBadFrame, "ref must be at most %d bytes", maxRefLength)
+	}
+	switch m.Type {
+	case TypeChat:
+		if err := m.checkBody(); err != nil {
+			return err
+		}
+		return checkRoom(m.Room)
+	case TypeDirect:
+		if err := m.checkBody(); err != nil {
+			return err
+		}
+		if !ValidUserName(m.To) {
+			return frameErrorf(CodeUnknownUser, "%q is not a user name", m.To)
+		}
+		return nil
+	case TypeLeave, TypeTyping, TypeWho:
+		return checkRoom(m.Room)
+	case TypeJoin:
+		if m.After != "" && !ValidMessageID(m.After) {
+			return frameErrorf(CodeBadFrame, "after must be a message ID")
+		}
+		return checkRoom(m.Room)
+	case TypeDelivered, TypeRead:
+		if !ValidMessageID(m.ID) {
+			return frameErrorf(CodeBadFrame, "id must be a message ID")
+		}
+		return checkRoom(m.Room)
+	case TypeHistory:
+		if m.Before != "" && !ValidMessageID(m.Before) {
+			return frameErrorf(CodeBadFrame, "before must be a message ID")
+		}
+		if m.After != "" && !ValidMessageID(m.After) {
+			return frameErrorf(CodeBadFrame, "after must be a message ID")
+		}
+		if m.Before != "" && m.After != "" {
+			return frameErrorf(CodeBadFrame, "before and after cannot be combined")
+		}
+		if m.Limit < 0 || m.Limit > MaxHistoryLimit {
+			return frameErrorf(CodeBadFrame, "limit must be between 1 and %d", MaxHistoryLimit)
+		}
+		return checkRoom(m.Room)
+	case TypeRooms:
+		return nil
+	case "":
+		return frameErrorf(CodeBadFrame, "type is required")
+	default:
+		return frameErrorf(CodeBadFrame, "clients cannot send %q frames", m.Type)
+	}
+}
+
+func (m *Message) checkBody() error {
+	if strings.TrimSpace(m.Body) == "" {
+		return frameErrorf(CodeBadFrame, "%s body must not be empty", m.Type)
+	}
+	if len(m.Body) > maxBodyLength {
+		return frameErrorf(CodeBadFrame, "%s body must be at most %d bytes", m.Type, maxBodyLength)
+	}
+	return nil
+}
+
+// ValidNick allows letters, digits, '-', '_' and '.'. User names follow the
+// same rule since a user's name is their nickname unless they pick another.
+func ValidNick(nick string) bool {
+	if nick == "" || len(nick) > maxNickLength {
+		return false
+	}
+	for _, c := range nick {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') &&
+			c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func ValidUserName(name string) bool {
+	return ValidNick(name)
+}
+
+// ValidRoomName allows lower case letters, digits, '-' and '_' so room names
+// are easy to type in a /join command.
+func ValidRoomName(name string) bool {
+	if name == "" || len(name) > maxRoomNameLength {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidMessageID reports whether id looks like an ID handed out by the
+// server: 24 lower case hex digits.
+func ValidMessageID(id string) bool {
+	if len(id) != 24 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func checkRoom(name string) error {
+	if !ValidRoomName(name) {
+		return frameErrorf(CodeBadRoom, "room must be 1 to %d of a-z, 0-9, - and _", maxRoomNameLength)
+	}
+	return nil
+}
+
+// errorCode picks the code for an error event.
+func errorCode(err error) string {
+	var fe *FrameError
+	if errors.As(err, &fe) {
+		return fe.Code
+	}
+	return CodeBadFrame
+}
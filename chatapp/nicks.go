@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// nickRegistry keeps nicknames unique among connected users, ignoring case.
+// A user may hold the same nickname on several connections at once, so
+// claims are counted and the nickname is freed by the last release.
+//
+// Nicknames held on other servers sharing the broker are refused too. They
+// are learnt from the servers' snapshots and Online news, so two servers
+// handing out one nickname at the same moment may still both succeed.
+type nickRegistry struct {
+	mu     sync.Mutex
+	owners map[string]*nickOwner
+	remote map[string]map[string]string // per server, the user holding each folded nickname
+}
+
+type nickOwner struct {
+	user  string
+	conns int
+}
+
+// claim reserves nick for user and reports whether it could. It is called
+// during the handshake, before the connection is upgraded, so a taken
+// nickname can be refused with a plain HTTP error.
+func (n *nickRegistry) claim(nick, user string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := foldName(nick)
+	for _, held := range n.remote {
+		if other, ok := held[key]; ok && other != user {
+			return false
+		}
+	}
+	owner, ok := n.owners[key]
+	if !ok {
+		if n.owners == nil {
+			n.owners = make(map[string]*nickOwner)
+		}
+		owner = &nickOwner{user: user}
+		n.owners[key] = owner
+	}
+	if owner.user != user {
+		return false
+	}
+	owner.conns++
+	return true
+}
+
+// reservedNick reports whether nick is the name of a registered user other
+// than user. Taking it while they are offline would lock them out of their
+// own name once they connect.
+func reservedNick(auth Authenticator, nick string, user User) bool {
+	if strings.EqualFold(nick, user.Name) {
+		return false
+	}
+	return registeredUser(auth, nick)
+}
+
+// foldName is the key nicknames and user names are compared by. Both are
+// ASCII, so it agrees with strings.EqualFold.
+func foldName(name string) string {
+	return strings.ToLower(name)
+}
+
+// foldedDirectory is implemented by user directories that can look a name up
+// ignoring case.
+type foldedDirectory interface {
+	HasUserFold(name string) bool
+}
+
+// registeredUser asks the user directories behind auth whether name, in any
+// case, is a user's name. Unlike ChainAuthenticator.HasUser it skips
+// authenticators that let anyone in, since guests only have the names they
+// are given.
+func registeredUser(auth Authenticator, name string) bool {
+	switch a := auth.(type) {
+	case ChainAuthenticator:
+		for _, member := range a {
+			if registeredUser(member, name) {
+				return true
+			}
+		}
+		return false
+	case foldedDirectory:
+		return a.HasUserFold(name)
+	case UserDirectory:
+		return a.HasUser(name) || a.HasUser(foldName(name))
+	default:
+		return false
+	}
+}
+
+func (n *nickRegistry) release(nick string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := foldName(nick)
+	if owner, ok := n.owners[key]; ok {
+		owner.conns--
+		if owner.conns <= 0 {
+			delete(n.owners, key)
+		}
+	}
+}
+
+// setRemote records the nicknames user holds on the server node, replacing
+// those it held before. No nicks means the user left that server.
+func (n *nickRegistry) setRemote(node, user string, nicks []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	held := n.remote[node]
+	for key, owner := range held {
+		if owner == user {
+			delete(held, key)
+		}
+	}
+	if len(nicks) == 0 {
+		return
+	}
+	if held == nil {
+		if n.remote == nil {
+			n.remote = make(map[string]map[string]string)
+		}
+		held = make(map[string]string)
+		n.remote[node] = held
+	}
+	for _, nick := range nicks {
+		held[foldName(nick)] = user
+	}
+}
+
+// setRemoteNode replaces everything known about the nicknames held on the
+// server node with claims, the nicknames of each of its users. Nil claims
+// forget the server.
+func (n *nickRegistry) setRemoteNode(node string, claims map[string][]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if claims == nil {
+		delete(n.remote, node)
+		return
+	}
+	held := make(map[string]string)
+	for user, nicks := range claims {
+		for _, nick := range nicks {
+			held[foldName(nick)] = user
+		}
+	}
+	if n.remote == nil {
+		n.remote = make(map[string]map[string]string)
+	}
+	n.remote[node] = held
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReservedNickIgnoresCase(t *testing.T) {
+	dir := t.TempDir()
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.WriteFile(tokens, []byte("t1 Alice\nt2 bob\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	passwords := filepath.Join(dir, "passwords")
+	if err := os.WriteFile(passwords, []byte("McCoy:pbkdf2-sha256$1$AAAA$AAAA\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ta, err := LoadTokens(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pa, err := LoadPasswords(passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := ChainAuthenticator{ta, pa, &GuestAuthenticator{}}
+
+	bob := User{Name: "bob"}
+	for _, nick := range []string{"Alice", "alice", "ALICE", "aLiCe", "McCoy", "mccoy", "MCCOY"} {
+		if !reservedNick(auth, nick, bob) {
+			t.Errorf("bob may take %q", nick)
+		}
+	}
+	for _, nick := range []string{"BOB", "carol", "Alicia"} {
+		if reservedNick(auth, nick, bob) {
+			t.Errorf("bob may not take %q", nick)
+		}
+	}
+	alice := User{Name: "Alice"}
+	for _, nick := range []string{"Alice", "ALICE", "alice"} {
+		if reservedNick(auth, nick, alice) {
+			t.Errorf("Alice may not take their own name as %q", nick)
+		}
+	}
+}
+
+func TestNickHeldOnAnotherServerIsRefused(t *testing.T) {
+	b := NewMemoryBroker()
+	t.Cleanup(func() { b.Close() })
+	var servers [2]*httptest.Server
+	for i, prefix := range []string{"a-", "b-"} {
+		s := NewServer(&GuestAuthenticator{Prefix: prefix}, NewMemoryHistory(100), NewMemoryMailbox(), 0)
+		if err := s.ConnectBroker(b, "chat"); err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = serveTest(t, s)
+	}
+	dial := func(ts *httptest.Server, nick string) (*websocket.Conn, int) {
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?nick="+nick, nil)
+		if err != nil {
+			if resp == nil {
+				t.Fatal(err)
+			}
+			return nil, resp.StatusCode
+		}
+		return conn, http.StatusSwitchingProtocols
+	}
+
+	zed := dialTest(t, servers[0], "nick=Zed", false)
+	waitUntil(t, "the second server refuses the nickname", func() bool {
+		conn, status := dial(servers[1], "ZED")
+		if conn != nil {
+			conn.Close()
+		}
+		return status == http.StatusConflict
+	})
+
+	zed.Close()
+	waitUntil(t, "the second server hands out the nickname", func() bool {
+		conn, _ := dial(servers[1], "zed")
+		if conn != nil {
+			conn.Close()
+			return true
+		}
+		return false
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"time"
+)
+
+// Servers sharing a broker tell each other which users they have and who of
+// them is in which room, so that a direct message to a user connected
+// elsewhere is not put in the mailbox and who and rooms answers cover every
+// server. Rooms are followed through the join and leave events.
+// Besides the Online and Offline news every server sends a snapshot each
+// snapshotInterval, and one right away to a server it has not heard of. A
+// server not heard of for peerTimeout is forgotten with its users, which is
+// how the users of a crashed server go offline. The nicknames each user holds
+// come along, so that a nickname is only handed out once across the servers.
+const (
+	snapshotInterval = 15 * time.Second
+	peerTimeout      = 3 * snapshotInterval
+)
+
+type nodeSnapshot struct {
+	Users []string              `json:"users"`
+	Nicks map[string][]string   `json:"nicks,omitempty"` // per user, the nicknames of their connections
+	Rooms map[string][]UserInfo `json:"rooms,omitempty"`
+}
+
+// peer is what this server knows about another server on the broker.
+type peer struct {
+	users map[string]bool
+	rooms map[string]map[string][]string // nicknames of the users in each room
+	seen  time.Time
+}
+
+func (p *peer) join(room, user, nick string) {
+	users, ok := p.rooms[room]
+	if !ok {
+		users = make(map[string][]string)
+		p.rooms[room] = users
+	}
+	if !slices.Contains(users[user], nick) {
+		users[user] = append(users[user], nick)
+	}
+}
+
+func (p *peer) leave(room, user string) {
+	delete(p.rooms[room], user)
+	if len(p.rooms[room]) == 0 {
+		delete(p.rooms, room)
+	}
+}
+
+// handleRemote acts on an envelope from another server. It must only be
+// called from Run.
+func (s *Server) handleRemote(env *brokerEnvelope) {
+	p, ok := s.peers[env.Node]
+	if !ok {
+		p = &peer{users: make(map[string]bool), rooms: make(map[string]map[string][]string)}
+		s.peers[env.Node] = p
+		s.publishSnapshot()
+	}
+	p.seen = time.Now()
+
+	switch {
+	case env.Snapshot != nil:
+		p.users = make(map[string]bool, len(env.Snapshot.Users))
+		for _, name := range env.Snapshot.Users {
+			p.users[name] = true
+		}
+		claims := env.Snapshot.Nicks
+		if claims == nil {
+			claims = map[string][]string{}
+		}
+		s.nicks.setRemoteNode(env.Node, claims)
+		p.rooms = make(map[string]map[string][]string, len(env.Snapshot.Rooms))
+		for room, users := range env.Snapshot.Rooms {
+			for _, user := range users {
+				for _, nick := range user.Nicks {
+					p.join(room, user.Name, nick)
+				}
+			}
+		}
+	case env.Online != "":
+		p.users[env.Online] = true
+		s.nicks.setRemote(env.Node, env.Online, env.Nicks)
+	case env.Offline != "":
+		delete(p.users, env.Offline)
+		s.nicks.setRemote(env.Node, env.Offline, nil)
+		for room := range p.rooms {
+			p.leave(room, env.Offline)
+		}
+	case env.Msg != nil && env.Msg.Type == TypeDirect:
+		s.deliverDirect(env.Msg, nil)
+	case env.Msg != nil:
+		// Every server keeps the whole history, so a client resuming here
+		// catches up on rooms talked in elsewhere.
+		switch env.Msg.Type {
+		case TypeChat:
+			msg := env.Msg
+			s.queueStore(&storeJob{chat: msg, done: func(err error) {
+				if err != nil {
+					log.Printf("Error saving message from the broker to history: %v", err)
+				}
+				s.noteSent(msg)
+				s.fanoutLocal(msg.Room, msg, nil)
+			}})
+			return
+		case TypeJoin:
+			p.join(env.Msg.Room, env.Msg.From, env.Msg.Nick)
+		case TypeLeave:
+			p.leave(env.Msg.Room, env.Msg.From)
+		case TypeDelivered, TypeRead:
+			s.moveMarker(env.Msg)
+			return
+		}
+		s.fanoutLocal(env.Msg.Room, env.Msg, nil)
+	}
+}
+
+// publishSnapshot tells the other servers every user connected here and the
+// rooms they are in. It must only be called from Run.
+func (s *Server) publishSnapshot() {
+	snap := &nodeSnapshot{
+		Users: make([]string, 0, len(s.users)),
+		Nicks: make(map[string][]string, len(s.users)),
+		Rooms: make(map[string][]UserInfo, len(s.rooms)),
+	}
+	for name := range s.users {
+		snap.Users = append(snap.Users, name)
+		snap.Nicks[name] = s.nicksOf(name)
+	}
+	for room := range s.rooms {
+		snap.Rooms[room] = s.whoIsHere(room, false)
+	}
+	s.publishEnvelope(&brokerEnvelope{Snapshot: snap})
+}
+
+func (s *Server) expirePeers(now time.Time) {
+	for node, p := range s.peers {
+		if now.Sub(p.seen) > peerTimeout {
+			delete(s.peers, node)
+			s.nicks.setRemoteNode(node, nil)
+		}
+	}
+}
+
+// publishOnline tells the other servers that user is connected here and
+// with which nicknames. It is sent whenever those change, not only for the
+// first connection. It must only be called from Run.
+func (s *Server) publishOnline(user string) {
+	s.publishEnvelope(&brokerEnvelope{Online: user, Nicks: s.nicksOf(user)})
+}
+
+// nicksOf returns the nicknames of the connections of user here. It must
+// only be called from Run.
+func (s *Server) nicksOf(user string) []string {
+	var nicks []string
+	for client := range s.users[user] {
+		if !slices.Contains(nicks, client.nick) {
+			nicks = append(nicks, client.nick)
+		}
+	}
+	return nicks
+}
+
+// onlineElsewhere reports whether user is connected to another server. It
+// must only be called from Run.
+func (s *Server) onlineElsewhere(user string) bool {
+	for _, p := range s.peers {
+		if p.users[user] {
+			return true
+		}
+	}
+	return false
+}
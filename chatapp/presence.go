@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+// typingInterval is the least time between two typing events of a user in
+// a room; more frequent ones are dropped.
+const typingInterval = 3 * time.Second
+
+type typingKey struct {
+	room, user string
+}
+
+// userInRoom reports whether a connection of user other than skip is in
+// room. It must only be called from Run.
+func (s *Server) userInRoom(room, user string, skip *Client) bool {
+	for conn := range s.users[user] {
+		if conn != skip && conn.rooms[room] {
+			return true
+		}
+	}
+	return false
+}
+
+// whoIsHere lists the users in room with the nicknames of their
+// connections on this server and, when elsewhere is set, on the other
+// servers on the broker. It must only be called from Run.
+func (s *Server) whoIsHere(room string, elsewhere bool) []UserInfo {
+	byName := make(map[string]*UserInfo)
+	add := func(name, nick string) {
+		info, ok := byName[name]
+		if !ok {
+			info = &UserInfo{Name: name}
+			byName[name] = info
+		}
+		if !slices.Contains(info.Nicks, nick) {
+			info.Nicks = append(info.Nicks, nick)
+		}
+	}
+	for member := range s.rooms[room] {
+		add(member.user.Name, member.nick)
+	}
+	if elsewhere {
+		for _, p := range s.peers {
+			for name, nicks := range p.rooms[room] {
+				for _, nick := range nicks {
+					add(name, nick)
+				}
+			}
+		}
+	}
+	users := make([]UserInfo, 0, len(byName))
+	for _, info := range byName {
+		sort.Strings(info.Nicks)
+		users = append(users, *info)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// relayTyping tells the rest of the room that client's user is typing,
+// unless it was told so less than typingInterval ago. It must only be
+// called from Run.
+func (s *Server) relayTyping(client *Client, room string) {
+	key := typingKey{room: room, user: client.user.Name}
+	now := time.Now()
+	if now.Sub(s.typing[key]) < typingInterval {
+		return
+	}
+	s.typing[key] = now
+	s.fanout(room, &Message{Type: TypeTyping, Room: room, From: client.user.Name, Nick: client.nick, Time: now.UTC()}, client)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// readMarker is how far a user got in a room: the last message their
+// clients received and the last one they read. Message IDs sort by time,
+// so a marker covers every message up to its ID.
+type readMarker struct {
+	delivered, read string
+}
+
+// markRead records a delivered or read marker sent by client and passes it
+// on to the other servers. A marker past the newest message of the room is
+// refused, since it would hide the status of every message still to come.
+// It must only be called from Run.
+func (s *Server) markRead(client *Client, msg *Message) {
+	newest, ok := s.newest[msg.Room]
+	if !ok {
+		s.lookUpNewest(msg.Room, func(err error) {
+			if err != nil {
+				s.answer(client, errorEvent(msg.Ref, errors.New("history is not available")))
+			} else if s.clients[client] {
+				s.markRead(client, msg)
+			}
+		})
+		return
+	}
+	if msg.ID > newest {
+		client.deliver(errorEvent(msg.Ref, frameErrorf(CodeBadFrame, "#%s has no message %s", msg.Room, msg.ID)))
+		return
+	}
+	marker := &Message{Type: msg.Type, ID: msg.ID, Room: msg.Room, From: client.user.Name, Nick: client.nick, Time: time.Now().UTC()}
+	if s.moveMarker(marker) {
+		s.publish(marker)
+	}
+}
+
+// moveMarker records marker, from this server or another, and reports
+// whether it moved. Markers only move forward, and a read marker moves the
+// delivered one along. A marker is only sent to the users whose last
+// message in the room it newly covers, since clients show the status of
+// their last message. It must only be called from Run.
+func (s *Server) moveMarker(marker *Message) bool {
+	users, ok := s.markers[marker.Room]
+	if !ok {
+		users = make(map[string]*readMarker)
+		s.markers[marker.Room] = users
+	}
+	m, ok := users[marker.From]
+	if !ok {
+		m = &readMarker{}
+		users[marker.From] = m
+	}
+
+	var covered string // the marker covers messages after this one
+	switch {
+	case marker.Type == TypeDelivered && marker.ID > m.delivered:
+		covered = m.delivered
+	case marker.Type == TypeRead && marker.ID > m.read:
+		covered = m.read
+	default:
+		return false
+	}
+	m.delivered = max(m.delivered, marker.ID)
+	if marker.Type == TypeRead {
+		m.read = marker.ID
+	}
+
+	var data []byte
+	for user, last := range s.lastSent[marker.Room] {
+		if user == marker.From || last <= covered || last > marker.ID {
+			continue
+		}
+		if data == nil {
+			if data = encodeMessage(marker); data == nil {
+				return true
+			}
+		}
+		for conn := range s.users[user] {
+			if conn.rooms[marker.Room] {
+				conn.push(data)
+			}
+		}
+	}
+	return true
+}
+
+// noteSent records chat message msg, from this server or another, as the
+// last one of its sender and the newest of its room, once the newest one is
+// known. It must only be called from Run, after msg is stored.
+func (s *Server) noteSent(msg *Message) {
+	users, ok := s.lastSent[msg.Room]
+	if !ok {
+		users = make(map[string]string)
+		s.lastSent[msg.Room] = users
+	}
+	users[msg.From] = max(users[msg.From], msg.ID)
+	if newest, ok := s.newest[msg.Room]; ok {
+		s.newest[msg.Room] = max(newest, msg.ID)
+	}
+}
+
+// lookUpNewest asks the history store for the ID of the newest message in
+// room and calls then once s.newest has it, or with the error. It must only
+// be called from Run.
+func (s *Server) lookUpNewest(room string, then func(err error)) {
+	var newest string
+	read := func() error {
+		msgs, err := s.history.Before(room, "", 1)
+		if len(msgs) > 0 {
+			newest = msgs[0].ID
+		}
+		return err
+	}
+	s.queueStore(&storeJob{do: read, done: func(err error) {
+		if err != nil {
+			log.Printf("Error reading history of #%s: %v", room, err)
+			then(err)
+			return
+		}
+		// Messages stored before the lookup are in newest and those stored
+		// after it are noted from now on. Another lookup of the room may
+		// have finished first.
+		s.newest[room] = max(s.newest[room], newest)
+		then(nil)
+	}})
+}
+
+// sendMarkers tells client how far the other users got in room past the
+// last message client's user sent there, so that a client joining or coming
+// back can show the status of that message. Anything more would tell client
+// how far others read messages that are not its user's. It must only be
+// called from Run.
+func (s *Server) sendMarkers(client *Client, room string) {
+	own := s.lastSent[room][client.user.Name]
+	if own == "" {
+		return
+	}
+	users := s.markers[room]
+	names := make([]string, 0, len(users))
+	for name, m := range users {
+		if name != client.user.Name && m.delivered >= own {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := users[name]
+		client.deliver(&Message{Type: TypeDelivered, ID: m.delivered, Room: room, From: name})
+		if m.read >= own {
+			client.deliver(&Message{Type: TypeRead, ID: m.read, Room: room, From: name})
+		}
+	}
+}
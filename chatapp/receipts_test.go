@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJoiningSendsOnlyMarkersOfOwnMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("ta alice\ntb bob\ntc carol\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := LoadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := serveTest(t, NewServer(auth, NewMemoryHistory(100), NewMemoryMailbox(), 0))
+
+	alice := dialTest(t, ts, "token=ta", false)
+	aliceLog := readChats(alice)
+	bob := dialTest(t, ts, "token=tb", false)
+	bobLog := readChats(bob)
+	sendChat(t, alice, "hi")
+	bobLog.waitFor(t, "hi")
+	bobLog.mu.Lock()
+	id := bobLog.ids["hi"]
+	bobLog.mu.Unlock()
+	if err := bob.WriteJSON(&Message{Type: TypeRead, ID: id, Room: DefaultRoom}); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "alice hears bob read her message", func() bool {
+		aliceLog.mu.Lock()
+		defer aliceLog.mu.Unlock()
+		return len(aliceLog.markers) > 0
+	})
+
+	// joined opens a connection with token and returns the markers it got on
+	// joining, which all come before the answer to who.
+	joined := func(token string) []Message {
+		conn := dialTest(t, ts, "token="+token, false)
+		log := readChats(conn)
+		if err := conn.WriteJSON(&Message{Type: TypeWho, Room: DefaultRoom}); err != nil {
+			t.Fatal(err)
+		}
+		waitUntil(t, "who is answered", func() bool {
+			log.mu.Lock()
+			defer log.mu.Unlock()
+			return log.who != nil
+		})
+		log.mu.Lock()
+		defer log.mu.Unlock()
+		return log.markers
+	}
+
+	if markers := joined("tc"); len(markers) != 0 {
+		t.Errorf("carol, who sent nothing, got markers %+v", markers)
+	}
+	markers := joined("ta")
+	var read bool
+	for _, m := range markers {
+		if m.From != "bob" || m.ID != id {
+			t.Errorf("alice got marker %+v", m)
+		}
+		read = read || m.Type == TypeRead
+	}
+	if !read {
+		t.Error("alice's second connection did not hear bob read her message")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisBroker is a Broker over Redis pub/sub, or anything that speaks its
+// protocol (RESP), such as Valkey or KeyDB. It keeps one connection for
+// publishing and one per subscription, and redials either when it breaks.
+type RedisBroker struct {
+	addr     string
+	password string
+
+	mu     sync.Mutex
+	pub    *respConn
+	conns  map[*respConn]bool // subscription connections, closed by Close
+	closed bool
+}
+
+// NewRedisBroker connects to a redis://[:password@]host[:port] URL.
+func NewRedisBroker(rawURL string) (*RedisBroker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("broker URL %q: want a redis:// URL", rawURL)
+	}
+	b := &RedisBroker{addr: u.Host, conns: make(map[*respConn]bool)}
+	if u.Port() == "" {
+		b.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if pw, ok := u.User.Password(); ok {
+		b.password = pw
+	}
+
+	// Fail at start up rather than on the first message.
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.pub = conn
+	return b, nil
+}
+
+func (b *RedisBroker) dial() (*respConn, error) {
+	nc, err := net.DialTimeout("tcp", b.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &respConn{Conn: nc, r: bufio.NewReader(nc)}
+	cmd := []string{"PING"}
+	if b.password != "" {
+		cmd = []string{"AUTH", b.password}
+	}
+	if _, err := c.do(cmd...); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("redis %s: %w", b.addr, err)
+	}
+	return c, nil
+}
+
+func (b *RedisBroker) Publish(channel string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errBrokerClosed
+	}
+	// An idle connection may have been dropped by the server since the last
+	// message, so a fresh one gets a second chance.
+	var err error
+	for range 2 {
+		if b.pub == nil {
+			if b.pub, err = b.dial(); err != nil {
+				return err
+			}
+		}
+		b.pub.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = b.pub.do("PUBLISH", channel, string(data))
+		var re redisError
+		if err == nil || errors.As(err, &re) {
+			return err
+		}
+		b.pub.Close()
+		b.pub = nil
+	}
+	return err
+}
+
+func (b *RedisBroker) Subscribe(channel string) (<-chan []byte, error) {
+	conn, err := b.subscribe(channel)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make(chan []byte, 256)
+	go func() {
+		defer close(msgs)
+		retry := 100 * time.Millisecond
+		for {
+			err := b.receive(conn, channel, msgs)
+			if b.isClosed() {
+				return
+			}
+			log.Printf("Lost broker subscription: %v", err)
+			for {
+				time.Sleep(retry)
+				if b.isClosed() {
+					return
+				}
+				if conn, err = b.subscribe(channel); err == nil {
+					log.Println("Broker subscription restored")
+					retry = 100 * time.Millisecond
+					break
+				}
+				retry = min(2*retry, 10*time.Second)
+			}
+		}
+	}()
+	return msgs, nil
+}
+
+func (b *RedisBroker) subscribe(channel string) (*respConn, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.do("SUBSCRIBE", channel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		conn.Close()
+		return nil, errBrokerClosed
+	}
+	b.conns[conn] = true
+	return conn, nil
+}
+
+// receive passes on the messages of a subscribed connection until it fails.
+func (b *RedisBroker) receive(conn *respConn, channel string, msgs chan<- []byte) error {
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, conn)
+		b.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+		// Pushed messages are ["message", channel, payload].
+		parts, ok := reply.([]any)
+		if !ok || len(parts) != 3 {
+			continue
+		}
+		kind, _ := parts[0].([]byte)
+		from, _ := parts[1].([]byte)
+		data, _ := parts[2].([]byte)
+		if string(kind) == "message" && string(from) == channel {
+			msgs <- data
+		}
+	}
+}
+
+func (b *RedisBroker) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+func (b *RedisBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if b.pub != nil {
+		b.pub.Close()
+	}
+	for conn := range b.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// respConn speaks the Redis serialization protocol, just enough of it for
+// pub/sub.
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply; the connection is still fine after one.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *respConn) do(args ...string) (any, error) {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read returns the next reply: a string for simple strings, an int64 for
+// integers, []byte or nil for bulk strings and []any for arrays.
+func (c *respConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeRedis speaks just enough RESP for RedisBroker: PING, AUTH, PUBLISH
+// and SUBSCRIBE.
+type fakeRedis struct {
+	mu   sync.Mutex
+	subs map[string]map[*fakeRedisConn]bool
+}
+
+type fakeRedisConn struct {
+	mu sync.Mutex // serializes replies and pushed messages
+	net.Conn
+}
+
+func (c *fakeRedisConn) reply(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Write([]byte(s))
+}
+
+func bulkString(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+// startFakeRedis listens on a free local port and returns its address.
+func startFakeRedis(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeRedis{subs: make(map[string]map[*fakeRedisConn]bool)}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(&fakeRedisConn{Conn: nc})
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(c *fakeRedisConn) {
+	defer func() {
+		f.mu.Lock()
+		for _, conns := range f.subs {
+			delete(conns, c)
+		}
+		f.mu.Unlock()
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		switch {
+		case args[0] == "PING" || args[0] == "AUTH":
+			c.reply("+OK\r\n")
+		case args[0] == "SUBSCRIBE" && len(args) == 2:
+			f.mu.Lock()
+			if f.subs[args[1]] == nil {
+				f.subs[args[1]] = make(map[*fakeRedisConn]bool)
+			}
+			f.subs[args[1]][c] = true
+			f.mu.Unlock()
+			c.reply("*3\r\n" + bulkString("subscribe") + bulkString(args[1]) + ":1\r\n")
+		case args[0] == "PUBLISH" && len(args) == 3:
+			push := "*3\r\n" + bulkString("message") + bulkString(args[1]) + bulkString(args[2])
+			f.mu.Lock()
+			n := len(f.subs[args[1]])
+			for sub := range f.subs[args[1]] {
+				sub.reply(push)
+			}
+			f.mu.Unlock()
+			c.reply(":" + strconv.Itoa(n) + "\r\n")
+		default:
+			c.reply("-ERR unknown command\r\n")
+		}
+	}
+}
+
+// readCommand reads an array of bulk strings, which is how clients send
+// commands.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	c := &respConn{r: r}
+	reply, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]any)
+	if !ok || len(items) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	args := make([]string, len(items))
+	for i, item := range items {
+		arg, ok := item.([]byte)
+		if !ok {
+			return nil, io.ErrUnexpectedEOF
+		}
+		args[i] = string(arg)
+	}
+	return args, nil
+}
+
+func TestRedisBrokerConnectsServers(t *testing.T) {
+	addr := startFakeRedis(t)
+	var servers [2]*Server
+	var logs [2]*chatLog
+	var conns [2]*websocket.Conn
+	for i, prefix := range []string{"a-", "b-"} {
+		b, err := NewRedisBroker("redis://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { b.Close() })
+		s := NewServer(&GuestAuthenticator{Prefix: prefix}, NewMemoryHistory(100), NewMemoryMailbox(), 0)
+		if err := s.ConnectBroker(b, "chat"); err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = s
+		conns[i] = dialTest(t, serveTest(t, s), "", false)
+		logs[i] = readChats(conns[i])
+	}
+
+	// The second client may not be in the room yet when the first talks, so
+	// the first message is repeated until it gets across.
+	deadline := time.Now().Add(10 * time.Second)
+	for !logs[1].has("hello from a") {
+		if time.Now().After(deadline) {
+			t.Fatal("a message to the first server never reached the second")
+		}
+		sendChat(t, conns[0], "hello from a")
+		time.Sleep(50 * time.Millisecond)
+	}
+	sendChat(t, conns[1], "hello from b")
+	logs[0].waitFor(t, "hello from b")
+
+	// The first server heard of the second one's user joining before it
+	// heard them talk.
+	if err := conns[0].WriteJSON(&Message{Type: TypeWho, Room: DefaultRoom}); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "who lists both users", func() bool {
+		logs[0].mu.Lock()
+		defer logs[0].mu.Unlock()
+		return len(logs[0].who) == 2
+	})
+
+	// Each server keeps the other's messages too.
+	for i, body := range []string{"hello from b", "hello from a"} {
+		msgs, err := servers[i].history.Before(DefaultRoom, "", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, msg := range msgs {
+			found = found || msg.Body == body
+		}
+		if !found {
+			t.Errorf("history of server %d lacks %q", i, body)
+		}
+	}
+}
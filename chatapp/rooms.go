@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// fanout sends msg to every member of room except skip, which may be nil,
+// and to the other servers on the broker. It must only be called from Run.
+func (s *Server) fanout(room string, msg *Message, skip *Client) {
+	s.fanoutLocal(room, msg, skip)
+	s.publish(msg)
+}
+
+// fanoutLocal sends msg to the members of room connected to this server.
+func (s *Server) fanoutLocal(room string, msg *Message, skip *Client) {
+	data := encodeMessage(msg)
+	if data == nil {
+		return
+	}
+	for member := range s.rooms[room] {
+		if member != skip {
+			member.push(data)
+		}
+	}
+}
+
+// addMember and removeMember must only be called from Run. The room hears
+// of a user joining with their first connection and leaving with their last;
+// a connection joining or leaving in between only hears of itself. Empty
+// rooms are dropped so the room list only shows rooms someone is in.
+func (s *Server) addMember(room string, client *Client) {
+	if client.rooms[room] {
+		return
+	}
+	members, ok := s.rooms[room]
+	if !ok {
+		members = make(map[*Client]bool)
+		s.rooms[room] = members
+	}
+	present := s.userInRoom(room, client.user.Name, client)
+	members[client] = true
+	client.rooms[room] = true
+	join := &Message{Type: TypeJoin, Room: room, From: client.user.Name, Nick: client.nick, Time: time.Now().UTC()}
+	if present {
+		client.deliver(join)
+	} else {
+		s.fanout(room, join, nil)
+	}
+}
+
+func (s *Server) removeMember(room string, client *Client) {
+	members := s.rooms[room]
+	if !members[client] {
+		return
+	}
+	leave := &Message{Type: TypeLeave, Room: room, From: client.user.Name, Nick: client.nick, Time: time.Now().UTC()}
+	if s.userInRoom(room, client.user.Name, client) {
+		client.deliver(leave)
+	} else {
+		s.fanout(room, leave, nil)
+		delete(s.typing, typingKey{room: room, user: client.user.Name})
+	}
+	delete(members, client)
+	delete(client.rooms, room)
+	if len(members) == 0 {
+		delete(s.rooms, room)
+	}
+}
+
+// roomList lists the rooms someone is in on this server or on the other
+// servers on the broker. It must only be called from Run.
+func (s *Server) roomList() []RoomInfo {
+	users := make(map[string]map[string]bool)
+	add := func(room, user string) {
+		if users[room] == nil {
+			users[room] = make(map[string]bool)
+		}
+		users[room][user] = true
+	}
+	for room, members := range s.rooms {
+		for member := range members {
+			add(room, member.user.Name)
+		}
+	}
+	for _, p := range s.peers {
+		for room, nicks := range p.rooms {
+			for name := range nicks {
+				add(room, name)
+			}
+		}
+	}
+	rooms := make([]RoomInfo, 0, len(users))
+	for name, members := range users {
+		rooms = append(rooms, RoomInfo{Name: name, Members: len(members)})
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
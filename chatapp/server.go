@@ -1,121 +1,634 @@
 package main
 
 import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	"github.com/gorilla/websocket"
 )
 
 type Client struct {
-	conn *websocket.Conn	// connection for each client
-	send chan []byte	//server pushes msg to send channel which deliver msg to client side through web socket connection
+	conn *websocket.Conn // connection for each client
+	send chan []byte     //server pushes msg to send channel which deliver msg to client side through web socket connection
+	user User
+	nick string
+
+	rooms map[string]bool // rooms the client is in; only touched by Run
+
+	policy    SlowPolicy
+	writeWait time.Duration // how long evict may wait to send its close frame
+	dropped   atomic.Int64  // messages dropped because the client was slow
+	evicted   atomic.Bool
+}
+
+// clientMessage is a validated frame on its way from a client to the hub.
+type clientMessage struct {
+	client *Client
+	msg    *Message
 }
 
 type Server struct {
 	clients    map[*Client]bool
-	broadcast  chan []byte
+	users      map[string]map[*Client]bool // connections of each user
+	rooms      map[string]map[*Client]bool
+	typing     map[typingKey]time.Time           // last typing event relayed per user and room
+	markers    map[string]map[string]*readMarker // per room and user; kept in memory only
+	lastSent   map[string]map[string]string      // per room and user, the ID of their last message
+	newest     map[string]string                 // per room, the ID of its newest message
+	incoming   chan clientMessage
 	register   chan *Client
 	unregister chan *Client
+
+	auth     Authenticator
+	nicks    nickRegistry
+	upgrader websocket.Upgrader
+
+	// node names this server on the broker; outbox holds messages to
+	// publish and remote receives those of other servers. peers is what
+	// the other servers told us about their users.
+	node   string
+	outbox chan []byte
+	remote chan *brokerEnvelope
+	peers  map[string]*peer
+
+	history HistoryStore
+	mailbox Mailbox
+	replay  int // messages replayed to a client joining a room
+
+	// queued is what Run wants of the store goroutine next; toStore hands it
+	// over and stored brings it back done (see store.go).
+	queued  []*storeJob
+	toStore chan []*storeJob
+	stored  chan []*storeJob
+
+	// SendBuffer is how many messages may wait for a client before
+	// SlowPolicy applies. A client may pick its own policy with the slow
+	// query parameter.
+	SendBuffer int
+	SlowPolicy SlowPolicy
+
+	// The server pings every client each PingInterval and drops those that
+	// send nothing, pongs included, within PongWait. A write that takes
+	// longer than WriteWait, or a frame larger than MaxFrameSize, drops the
+	// client too.
+	PingInterval time.Duration
+	PongWait     time.Duration
+	WriteWait    time.Duration
+	MaxFrameSize int64
 }
 
-func NewServer() *Server {
+func NewServer(auth Authenticator, history HistoryStore, mailbox Mailbox, replay int) *Server {
 	return &Server{
-		clients: make(map[*Client]bool),
-		broadcast: make(chan []byte),
-		register: make(chan *Client),
+		auth:       auth,
+		history:    history,
+		mailbox:    mailbox,
+		replay:     replay,
+		clients:    make(map[*Client]bool),
+		users:      make(map[string]map[*Client]bool),
+		rooms:      make(map[string]map[*Client]bool),
+		typing:     make(map[typingKey]time.Time),
+		markers:    make(map[string]map[string]*readMarker),
+		lastSent:   make(map[string]map[string]string),
+		newest:     make(map[string]string),
+		incoming:   make(chan clientMessage),
+		remote:     make(chan *brokerEnvelope),
+		peers:      make(map[string]*peer),
+		toStore:    make(chan []*storeJob),
+		stored:     make(chan []*storeJob),
+		register:   make(chan *Client),
 		unregister: make(chan *Client),
+
+		SendBuffer:   256,
+		SlowPolicy:   DropOldest,
+		PingInterval: 30 * time.Second,
+		PongWait:     60 * time.Second,
+		WriteWait:    10 * time.Second,
+		MaxFrameSize: 2 * maxBodyLength,
 	}
 }
 
 func (s *Server) Run() {
+	var snapshots <-chan time.Time
+	if s.outbox != nil {
+		ticker := time.NewTicker(snapshotInterval)
+		defer ticker.Stop()
+		snapshots = ticker.C
+		s.publishSnapshot()
+	}
+	go s.runStore()
+
 	for {
+		var toStore chan<- []*storeJob
+		if len(s.queued) > 0 {
+			toStore = s.toStore
+		}
 		select {
+		case toStore <- s.queued:
+			s.queued = nil
+		case batch := <-s.stored:
+			for _, job := range batch {
+				job.done(job.err)
+			}
 		case client := <-s.register:
 			s.clients[client] = true
+			conns, ok := s.users[client.user.Name]
+			if !ok {
+				conns = make(map[*Client]bool)
+				s.users[client.user.Name] = conns
+			}
+			conns[client] = true
+			s.publishOnline(client.user.Name)
 			log.Println("New Client connected")
+			s.deliverPending(client)
 		case client := <-s.unregister:
 			if _, ok := s.clients[client]; ok {
+				for room := range client.rooms {
+					s.removeMember(room, client)
+				}
 				delete(s.clients, client)
+				delete(s.users[client.user.Name], client)
+				if len(s.users[client.user.Name]) == 0 {
+					delete(s.users, client.user.Name)
+					s.publishEnvelope(&brokerEnvelope{Offline: client.user.Name})
+				} else {
+					s.publishOnline(client.user.Name)
+				}
 				close(client.send)
-				log.Println("Client disconnected")
+				if n := client.dropped.Load(); n > 0 {
+					log.Printf("Client disconnected, %d messages to it were dropped", n)
+				} else {
+					log.Println("Client disconnected")
+				}
 			}
-		case message := <-s.broadcast:
-			for client := range s.clients {
-				client.send <- message
+		case in := <-s.incoming:
+			s.handleMessage(in.client, in.msg)
+		case env := <-s.remote:
+			s.handleRemote(env)
+		case now := <-snapshots:
+			s.expirePeers(now)
+			s.publishSnapshot()
+		}
+	}
+}
+
+// handleMessage acts on a frame from client. It must only be called from Run.
+func (s *Server) handleMessage(client *Client, msg *Message) {
+	switch msg.Type {
+	case TypeChat:
+		if !client.rooms[msg.Room] {
+			client.deliver(errorEvent(msg.Ref, frameErrorf(CodeNotMember, "join #%s before talking in it", msg.Room)))
+			return
+		}
+		chat := &Message{Type: TypeChat, ID: newMessageID(), Room: msg.Room, From: client.user.Name, Nick: client.nick, Time: time.Now().UTC(), Body: msg.Body}
+		// The ack promises the message is stored, so one that cannot be is
+		// not sent on either.
+		s.queueStore(&storeJob{chat: chat, done: func(err error) {
+			if err != nil {
+				log.Printf("Error saving message to history: %v", err)
+				s.answer(client, errorEvent(msg.Ref, frameErrorf(CodeNotStored, "the message could not be stored, send it again")))
+				return
+			}
+			s.noteSent(chat)
+			s.fanout(msg.Room, chat, nil)
+			s.answer(client, &Message{Type: TypeAck, ID: chat.ID, Ref: msg.Ref, Room: msg.Room, Time: chat.Time})
+		}})
+	case TypeDirect:
+		s.sendDirect(client, msg)
+	case TypeJoin:
+		// Joining a room again with After is how a client catches up.
+		if client.rooms[msg.Room] && msg.After == "" {
+			return
+		}
+		s.addMember(msg.Room, client)
+		if msg.After != "" {
+			s.sendHistory(client, &Message{Room: msg.Room, After: msg.After, Limit: MaxHistoryLimit})
+		} else if s.replay > 0 {
+			s.sendHistory(client, &Message{Room: msg.Room, Limit: s.replay})
+		}
+		s.afterStore(func() {
+			if s.clients[client] {
+				s.sendMarkers(client, msg.Room)
 			}
+		})
+	case TypeDelivered, TypeRead:
+		if !client.rooms[msg.Room] {
+			client.deliver(errorEvent(msg.Ref, frameErrorf(CodeNotMember, "you are not in #%s", msg.Room)))
+			return
+		}
+		s.markRead(client, msg)
+	case TypeLeave:
+		if !client.rooms[msg.Room] {
+			client.deliver(errorEvent(msg.Ref, frameErrorf(CodeNotMember, "you are not in #%s", msg.Room)))
+			return
+		}
+		s.removeMember(msg.Room, client)
+	case TypeRooms:
+		client.deliver(&Message{Type: TypeRooms, Ref: msg.Ref, Rooms: s.roomList()})
+	case TypeHistory:
+		if !client.rooms[msg.Room] {
+			client.deliver(errorEvent(msg.Ref, frameErrorf(CodeNotMember, "join #%s to read its history", msg.Room)))
+			return
+		}
+		s.sendHistory(client, msg)
+	case TypeWho:
+		if !client.rooms[msg.Room] {
+			client.deliver(errorEvent(msg.Ref, frameErrorf(CodeNotMember, "join #%s to see who is in it", msg.Room)))
+			return
+		}
+		client.deliver(&Message{Type: TypeWho, Ref: msg.Ref, Room: msg.Room, Users: s.whoIsHere(msg.Room, true)})
+	case TypeTyping:
+		if client.rooms[msg.Room] {
+			s.relayTyping(client, msg.Room)
 		}
 	}
 }
 
-func (s *Server) HandleClient(conn *websocket.Conn) {
+// sendHistory answers the history request req, which may also be the
+// replay a client gets when joining a room. It must only be called from Run.
+func (s *Server) sendHistory(client *Client, req *Message) {
+	limit := req.Limit
+	if limit == 0 {
+		limit = DefaultHistoryLimit
+	}
+	// One message more than asked for tells whether there are more.
+	var msgs []*Message
+	read := func() (err error) {
+		if req.After != "" {
+			msgs, err = s.history.After(req.Room, req.After, limit+1)
+		} else {
+			msgs, err = s.history.Before(req.Room, req.Before, limit+1)
+		}
+		return err
+	}
+	s.queueStore(&storeJob{do: read, done: func(err error) {
+		if err != nil {
+			log.Printf("Error reading history of #%s: %v", req.Room, err)
+			s.answer(client, errorEvent(req.Ref, errors.New("history is not available")))
+			return
+		}
+		more := len(msgs) > limit
+		if more && req.After != "" {
+			msgs = msgs[:limit]
+		} else if more {
+			msgs = msgs[1:]
+		}
+		s.answer(client, &Message{Type: TypeHistory, Ref: req.Ref, Room: req.Room, Before: req.Before, After: req.After, Messages: msgs, More: more})
+	}})
+}
+
+// deliver queues msg for the client's write loop.
+func (c *Client) deliver(msg *Message) {
+	if data := encodeMessage(msg); data != nil {
+		c.push(data)
+	}
+}
+
+func encodeMessage(msg *Message) []byte {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding %s message: %v", msg.Type, err)
+		return nil
+	}
+	return data
+}
+
+func errorEvent(ref string, err error) *Message {
+	return &Message{Type: TypeError, Ref: ref, Code: errorCode(err), Body: err.Error(), Time: time.Now().UTC()}
+}
+
+// ServeHTTP authenticates the handshake, claims the nickname given by the
+// nick query parameter, or the user name when there is none, and upgrades
+// the connection.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, err := s.auth.Authenticate(r)
+	if err != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="chat"`)
+		w.Header().Add("WWW-Authenticate", `Bearer realm="chat"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	nick := r.URL.Query().Get("nick")
+	if nick == "" {
+		nick = user.Name
+	}
+	if !ValidNick(nick) {
+		http.Error(w, fmt.Sprintf("nickname must be 1 to %d of letters, digits, -, _ and .", maxNickLength), http.StatusBadRequest)
+		return
+	}
+	if reservedNick(s.auth, nick, user) {
+		http.Error(w, fmt.Sprintf("nickname %s belongs to another user", nick), http.StatusConflict)
+		return
+	}
+	policy := s.SlowPolicy
+	if p := r.URL.Query().Get("slow"); p != "" {
+		if policy, err = parseSlowPolicy(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	after := r.URL.Query().Get("after")
+	if after != "" && !ValidMessageID(after) {
+		http.Error(w, "after must be a message ID", http.StatusBadRequest)
+		return
+	}
+	if !s.nicks.claim(nick, user.Name) {
+		http.Error(w, fmt.Sprintf("nickname %s is taken", nick), http.StatusConflict)
+		return
+	}
+
+	// Tell the client who it is, which it needs to tell its own messages and
+	// receipts from those of others.
+	header := http.Header{"X-Chat-User": {user.Name}, "X-Chat-Nick": {nick}}
+	wsConn, err := s.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		s.nicks.release(nick)
+		log.Println("Error upgrading Websocket:", err)
+		return
+	}
+
+	go s.HandleClient(wsConn, user, nick, policy, after)
+}
+
+// HandleClient serves an upgraded connection for user, who already holds
+// nick; it is released when the connection closes. A non-empty after
+// resumes DefaultRoom from that message.
+func (s *Server) HandleClient(conn *websocket.Conn, user User, nick string, policy SlowPolicy, after string) {
 	client := &Client{
-		conn: conn,
-		send: make(chan []byte, 256),
+		conn:      conn,
+		send:      make(chan []byte, s.SendBuffer),
+		user:      user,
+		nick:      nick,
+		rooms:     make(map[string]bool),
+		policy:    policy,
+		writeWait: s.WriteWait,
 	}
 
 	s.register <- client
 
-	defer func(){
+	defer func() {
 		s.unregister <- client
+		s.nicks.release(nick)
 		conn.Close()
 	}()
 
-	go func() {
-		for message := range client.send {
-			err := conn.WriteMessage(websocket.TextMessage, message)
-			if err != nil {
-				log.Printf("Error writing message: %v", err)
-				return
+	go s.writeLoop(client)
+
+	s.incoming <- clientMessage{client: client, msg: &Message{Type: TypeJoin, Room: DefaultRoom, After: after}}
+
+	conn.SetReadLimit(s.MaxFrameSize)
+	conn.SetReadDeadline(time.Now().Add(s.PongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(s.PongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Printf("Dropping %s: nothing received for %s", client.nick, s.PongWait)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Error reading from %s: %v", client.nick, err)
+			}
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(s.PongWait))
+
+		msg, err := ParseMessage(data)
+		if err != nil {
+			var ref string
+			if msg != nil {
+				ref = msg.Ref
 			}
+			client.deliver(errorEvent(ref, err))
+			continue
 		}
+
+		s.incoming <- clientMessage{client: client, msg: msg}
+	}
+}
+
+// writeLoop writes the client's queued messages and pings it. It is the
+// only goroutine writing to the connection, apart from the close frame of
+// evict. When a write fails it closes the connection so the read loop in
+// HandleClient ends too.
+func (s *Server) writeLoop(client *Client) {
+	conn := client.conn
+	ticker := time.NewTicker(s.PingInterval)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
 	}()
 
 	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			break
+		select {
+		case message, ok := <-client.send:
+			conn.SetWriteDeadline(time.Now().Add(s.WriteWait))
+			if !ok {
+				// Run unregistered the client.
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				if !closedConnError(err) {
+					log.Printf("Error writing message: %v", err)
+				}
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(s.WriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				if !closedConnError(err) {
+					log.Printf("Error pinging %s: %v", client.nick, err)
+				}
+				return
+			}
 		}
+	}
+}
+
+// closedConnError reports whether err only says that the connection was
+// closed already, by the read loop or by evict, which is not worth logging.
+func closedConnError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, websocket.ErrCloseSent)
+}
 
-		formattedMsg := fmt.Sprintf("Client %p: %s", client, message)
-		
-		s.broadcast <- []byte(formattedMsg)	  
+// openHistory opens the history store and the mailbox kept next to it. The
+// sql store holds both in one database.
+func openHistory(kind, path, mailboxPath, driver string, size int) (HistoryStore, Mailbox, error) {
+	switch kind {
+	case "memory":
+		return NewMemoryHistory(size), NewMemoryMailbox(), nil
+	case "file":
+		history, err := NewFileHistory(path, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		mailbox, err := NewFileMailbox(mailboxPath)
+		if err != nil {
+			history.Close()
+			return nil, nil, err
+		}
+		return history, mailbox, nil
+	case "sql":
+		history, err := NewSQLHistory(driver, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return history, history, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown history store %q (want memory, file or sql)", kind)
 	}
 }
 
 func main() {
 	port := flag.String("port", "8080", "port to start server on")
+	tokens := flag.String("tokens", "", "file of \"token username\" lines for bearer token logins")
+	passwords := flag.String("passwords", "", "file of \"username:hash\" lines for password logins")
+	historyKind := flag.String("history", "memory", "where to keep message history: memory, file or sql")
+	historyPath := flag.String("history-path", "history.jsonl", "history file for the file store, data source name for the sql store")
+	mailboxPath := flag.String("mailbox-path", "mailbox.jsonl", "file the file store keeps direct messages for offline users in")
+	historyDriver := flag.String("history-driver", "sqlite", "database/sql driver name for the sql history store")
+	historySize := flag.Int("history-size", 1000, "messages kept per room by the memory and file stores")
+	replay := flag.Int("replay", 50, "messages replayed to a client joining a room")
+	sendBuffer := flag.Int("send-buffer", 256, "messages that may wait for a client before -slow-policy applies")
+	pingInterval := flag.Duration("ping-interval", 30*time.Second, "how often to ping clients")
+	pongWait := flag.Duration("pong-wait", 60*time.Second, "how long a client may stay silent, pongs included, before it is dropped")
+	writeWait := flag.Duration("write-wait", 10*time.Second, "how long a write to a client may take")
+	maxFrameSize := flag.Int64("max-frame-size", 2*maxBodyLength, "largest frame in bytes a client may send")
+	brokerKind := flag.String("broker", "", "share rooms with other servers through a broker: memory or redis (default none)")
+	brokerURL := flag.String("broker-url", "redis://localhost:6379", "redis://[:password@]host[:port] of the redis broker")
+	brokerChannel := flag.String("broker-channel", "chat", "broker channel the servers share")
+	slowPolicy := flag.String("slow-policy", string(DropOldest), "what to do with clients that do not keep up: drop-oldest or disconnect")
+	hashPassword := flag.Bool("hash-password", false, "read a password from stdin, print its hash for the -passwords file and exit")
 	flag.Parse()
 
-	server := NewServer()
+	if *hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			log.Fatal("Error reading password:", err)
+		}
+		hash, err := HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatal("Error hashing password:", err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	var auth ChainAuthenticator
+	if *tokens != "" {
+		ta, err := LoadTokens(*tokens)
+		if err != nil {
+			log.Fatal("Error loading tokens:", err)
+		}
+		auth = append(auth, ta)
+	}
+	if *passwords != "" {
+		pa, err := LoadPasswords(*passwords)
+		if err != nil {
+			log.Fatal("Error loading passwords:", err)
+		}
+		auth = append(auth, pa)
+	}
+	if len(auth) == 0 {
+		log.Println("No -tokens or -passwords given, everyone joins as a guest")
+		guests := &GuestAuthenticator{}
+		if *brokerKind != "" {
+			var b [2]byte
+			rand.Read(b[:])
+			guests.Prefix = fmt.Sprintf("guest-%x-", b)
+		}
+		auth = append(auth, guests)
+	}
+
+	if *historySize < 1 {
+		log.Fatal("-history-size must be at least 1")
+	}
+	if *replay < 0 || *replay > MaxHistoryLimit {
+		log.Fatalf("-replay must be between 0 and %d", MaxHistoryLimit)
+	}
+	history, mailbox, err := openHistory(*historyKind, *historyPath, *mailboxPath, *historyDriver, *historySize)
+	if err != nil {
+		log.Fatal("Error opening history:", err)
+	}
+
+	policy, err := parseSlowPolicy(*slowPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *sendBuffer < 1 {
+		log.Fatal("-send-buffer must be at least 1")
+	}
+	if *pingInterval <= 0 || *pongWait <= *pingInterval {
+		log.Fatal("-pong-wait must be longer than -ping-interval, which must be positive")
+	}
+	if *writeWait <= 0 || *maxFrameSize < 1 {
+		log.Fatal("-write-wait and -max-frame-size must be positive")
+	}
+
+	server := NewServer(auth, history, mailbox, *replay)
+	server.SendBuffer = *sendBuffer
+	server.SlowPolicy = policy
+	server.PingInterval = *pingInterval
+	server.PongWait = *pongWait
+	server.WriteWait = *writeWait
+	server.MaxFrameSize = *maxFrameSize
+
+	var broker Broker
+	switch *brokerKind {
+	case "":
+	case "memory":
+		broker = NewMemoryBroker()
+	case "redis":
+		if broker, err = NewRedisBroker(*brokerURL); err != nil {
+			log.Fatal("Error connecting to broker: ", err)
+		}
+	default:
+		log.Fatalf("Unknown broker %q (want memory or redis)", *brokerKind)
+	}
+	if broker != nil {
+		if err := server.ConnectBroker(broker, *brokerChannel); err != nil {
+			log.Fatal("Error subscribing to broker: ", err)
+		}
+	}
 	go server.Run()
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
 	go func() {
-		<- interrupt
+		<-interrupt
 		log.Println("Shutting down server...")
+		if err := history.Close(); err != nil {
+			log.Println("Error closing history:", err)
+		}
+		if err := mailbox.Close(); err != nil {
+			log.Println("Error closing mailbox:", err)
+		}
+		if broker != nil {
+			broker.Close()
+		}
 		os.Exit(0)
 	}()
 
-	upgrader := websocket.Upgrader{}
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		wsConn, err := upgrader.Upgrade(w,r,nil)
-		if err != nil {
-			log.Println("Error upgrading Websocket:", err)
-			return
-		}
-
-		go server.HandleClient(wsConn)
-	})
+	http.Handle("/", server)
 
 	log.Printf("Server started on :%s", *port)
 	if err := http.ListenAndServe("localhost:"+*port, nil); err != nil {
 		log.Fatal("Listen and server error:", err)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowPolicy says what happens to a message for a client whose send buffer
+// is full, which means the client is not reading as fast as messages come.
+type SlowPolicy string
+
+const (
+	// DropOldest discards the oldest queued message to make room.
+	DropOldest SlowPolicy = "drop-oldest"
+	// Disconnect closes the connection; the client can reconnect and catch
+	// up from history.
+	Disconnect SlowPolicy = "disconnect"
+)
+
+func parseSlowPolicy(s string) (SlowPolicy, error) {
+	switch p := SlowPolicy(s); p {
+	case DropOldest, Disconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown slow client policy %q (want %s or %s)", s, DropOldest, Disconnect)
+	}
+}
+
+// Counters published on /debug/vars.
+var (
+	droppedMessages = expvar.NewInt("chat_dropped_messages")
+	slowDisconnects = expvar.NewInt("chat_slow_disconnects")
+)
+
+// push queues data for the client's write loop without ever blocking, so a
+// client that stopped reading cannot hold up the hub. When the buffer is
+// full the client's policy decides what gives.
+func (c *Client) push(data []byte) {
+	if c.evicted.Load() {
+		return
+	}
+	select {
+	case c.send <- data:
+		return
+	default:
+	}
+
+	switch c.policy {
+	case Disconnect:
+		c.evict()
+	default:
+		// The write loop may drain the buffer meanwhile, so neither step
+		// may block; whatever does not fit is dropped.
+		select {
+		case <-c.send:
+			c.dropped.Add(1)
+			droppedMessages.Add(1)
+		default:
+		}
+		select {
+		case c.send <- data:
+		default:
+			c.dropped.Add(1)
+			droppedMessages.Add(1)
+		}
+	}
+}
+
+// evict closes the connection of a client that fell behind. The read loop
+// then fails and unregisters the client as for any other disconnect.
+func (c *Client) evict() {
+	if c.evicted.Swap(true) {
+		return
+	}
+	slowDisconnects.Add(1)
+	log.Printf("Disconnecting %s (%s): not reading fast enough", c.nick, c.user.Name)
+	go func() {
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "not reading fast enough")
+		// The write loop may be stuck in a write for up to the write wait,
+		// and the close frame has to wait for it.
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.writeWait))
+		c.conn.Close()
+	}()
+}
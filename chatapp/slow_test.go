@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// socketBuffer is the size tests shrink socket buffers to, so that a client
+// that does not read backs the server up after a few messages instead of
+// megabytes.
+const socketBuffer = 4096
+
+// floodSize is how many near maximum chats fill a stalled client's socket
+// buffers and send buffer several times over.
+const floodSize = 200
+
+// smallBuffers shrinks the send buffer of every connection it accepts.
+type smallBuffers struct {
+	net.Listener
+}
+
+func (l smallBuffers) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		err = conn.(*net.TCPConn).SetWriteBuffer(socketBuffer)
+	}
+	return conn, err
+}
+
+func newTestServer(t *testing.T, policy SlowPolicy) *httptest.Server {
+	s := NewServer(&GuestAuthenticator{}, NewMemoryHistory(100), NewMemoryMailbox(), 0)
+	s.SendBuffer = 8
+	s.SlowPolicy = policy
+	return serveTest(t, s)
+}
+
+// serveTest runs s behind a test HTTP server.
+func serveTest(t *testing.T, s *Server) *httptest.Server {
+	go s.Run()
+	ts := httptest.NewUnstartedServer(s)
+	ts.Listener = smallBuffers{ts.Listener}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// dialTest connects to ts with the query string query. When stalled is set
+// the socket's receive buffer is shrunk too.
+func dialTest(t *testing.T, ts *httptest.Server, query string, stalled bool) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil && stalled {
+				err = conn.(*net.TCPConn).SetReadBuffer(socketBuffer)
+			}
+			return conn, err
+		},
+	}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func sendChat(t *testing.T, conn *websocket.Conn, body string) {
+	t.Helper()
+	if err := conn.WriteJSON(&Message{Type: TypeChat, Room: DefaultRoom, Body: body}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// chatLog collects the chat frames a connection receives.
+type chatLog struct {
+	mu      sync.Mutex
+	bodies  map[string]bool
+	ids     map[string]string // chat IDs by body
+	count   int
+	who     []UserInfo // the last answer to a who frame
+	markers []Message  // delivered and read frames
+	err     error      // why reading stopped, once it did
+}
+
+// readChats reads conn in the background until the connection fails.
+func readChats(conn *websocket.Conn) *chatLog {
+	l := &chatLog{bodies: make(map[string]bool), ids: make(map[string]string)}
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			l.mu.Lock()
+			if err != nil {
+				l.err = err
+				l.mu.Unlock()
+				return
+			}
+			var msg Message
+			if json.Unmarshal(data, &msg) == nil {
+				switch msg.Type {
+				case TypeChat:
+					l.bodies[msg.Body] = true
+					l.ids[msg.Body] = msg.ID
+					l.count++
+				case TypeWho:
+					l.who = msg.Users
+				case TypeDelivered, TypeRead:
+					l.markers = append(l.markers, msg)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+	return l
+}
+
+// has reports whether a chat with body has arrived.
+func (l *chatLog) has(body string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bodies[body]
+}
+
+// waitFor fails the test unless a chat with body arrives within a few
+// seconds, and returns how many chats had arrived by then.
+func (l *chatLog) waitFor(t *testing.T, body string) int {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.Lock()
+		seen, count, err := l.bodies[body], l.count, l.err
+		l.mu.Unlock()
+		if seen {
+			return count
+		}
+		if err != nil {
+			t.Fatalf("connection failed before %q arrived: %v", body, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%q did not arrive", body)
+	return 0
+}
+
+func flood(t *testing.T, sender *websocket.Conn) {
+	t.Helper()
+	filler := strings.Repeat("x", maxBodyLength-16)
+	for i := range floodSize {
+		sendChat(t, sender, fmt.Sprintf("%d %s", i, filler))
+	}
+}
+
+// waitUntil fails the test unless cond holds within a few seconds.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSlowClientIsDisconnected(t *testing.T) {
+	ts := newTestServer(t, DropOldest)
+	stalled := dialTest(t, ts, "slow=disconnect", true)
+	watcher := readChats(dialTest(t, ts, "", false))
+	sender := dialTest(t, ts, "", false)
+	readChats(sender)
+
+	before := slowDisconnects.Value()
+	flood(t, sender)
+	waitUntil(t, "the stalled client is disconnected", func() bool { return slowDisconnects.Value() > before })
+
+	// The close frame follows whatever was already on its way.
+	stalled.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var err error
+	for err == nil {
+		_, _, err = stalled.ReadMessage()
+	}
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("stalled client got %v, want close %d", err, websocket.ClosePolicyViolation)
+	}
+
+	sendChat(t, sender, "after the eviction")
+	watcher.waitFor(t, "after the eviction")
+}
+
+func TestSlowClientDropsOldest(t *testing.T) {
+	ts := newTestServer(t, DropOldest)
+	stalled := dialTest(t, ts, "", true)
+	watcher := readChats(dialTest(t, ts, "", false))
+	sender := dialTest(t, ts, "", false)
+	readChats(sender)
+
+	before := droppedMessages.Value()
+	flood(t, sender)
+	sendChat(t, sender, "last")
+	watcher.waitFor(t, "last")
+	if droppedMessages.Value() == before {
+		t.Error("chat_dropped_messages did not move")
+	}
+
+	// The stalled client is still connected and, once it reads, gets the
+	// newest message but not all of them.
+	if got := readChats(stalled).waitFor(t, "last"); got > floodSize {
+		t.Errorf("stalled client got all %d messages, want some dropped", got)
+	}
+}
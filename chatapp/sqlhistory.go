@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+var historySchema = []string{`CREATE TABLE IF NOT EXISTS messages (
+	id     TEXT PRIMARY KEY,
+	room   TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	nick   TEXT NOT NULL DEFAULT '',
+	ts     INTEGER NOT NULL,
+	body   TEXT NOT NULL
+)`,
+	`CREATE INDEX IF NOT EXISTS messages_room ON messages (room, id)`,
+	`CREATE TABLE IF NOT EXISTS mailbox (
+	id        TEXT PRIMARY KEY,
+	recipient TEXT NOT NULL,
+	sender    TEXT NOT NULL,
+	nick      TEXT NOT NULL DEFAULT '',
+	ts        INTEGER NOT NULL,
+	body      TEXT NOT NULL
+)`,
+	`CREATE INDEX IF NOT EXISTS mailbox_recipient ON mailbox (recipient, id)`,
+}
+
+// SQLHistory keeps messages in a SQL database through database/sql. Like
+// the link store of the URL shortener it sticks to plain SQL with ?
+// placeholders so it runs on SQLite; the pure Go modernc.org/sqlite driver
+// is linked in as "sqlite". It is a Mailbox too.
+type SQLHistory struct {
+	db *sql.DB
+}
+
+func NewSQLHistory(driver, dsn string) (*SQLHistory, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open %s database: %w", driver, err)
+	}
+	for _, stmt := range historySchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("create schema: %w", err)
+		}
+	}
+	return &SQLHistory{db: db}, nil
+}
+
+func (h *SQLHistory) Append(msgs ...*Message) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO messages (id, room, sender, nick, ts, body) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, msg := range msgs {
+		if _, err := stmt.Exec(msg.ID, msg.Room, msg.From, msg.Nick, msg.Time.UnixNano(), msg.Body); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (h *SQLHistory) Before(room, before string, limit int) ([]*Message, error) {
+	query := `SELECT id, sender, nick, ts, body FROM messages WHERE room = ?`
+	args := []any{room}
+	if before != "" {
+		query += ` AND id < ?`
+		args = append(args, before)
+	}
+	msgs, err := h.query(room, query+` ORDER BY id DESC LIMIT ?`, append(args, limit)...)
+	slices.Reverse(msgs)
+	return msgs, err
+}
+
+func (h *SQLHistory) After(room, after string, limit int) ([]*Message, error) {
+	return h.query(room, `SELECT id, sender, nick, ts, body FROM messages WHERE room = ? AND id > ? ORDER BY id LIMIT ?`, room, after, limit)
+}
+
+func (h *SQLHistory) query(room, query string, args ...any) ([]*Message, error) {
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []*Message
+	for rows.Next() {
+		msg := &Message{Type: TypeChat, Room: room}
+		var ts int64
+		if err := rows.Scan(&msg.ID, &msg.From, &msg.Nick, &ts, &msg.Body); err != nil {
+			return nil, err
+		}
+		msg.Time = time.Unix(0, ts).UTC()
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (h *SQLHistory) Put(msg *Message) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM mailbox WHERE recipient = ?`, msg.To).Scan(&n); err != nil {
+		return err
+	}
+	if n >= MaxPending {
+		return ErrMailboxFull
+	}
+	_, err = tx.Exec(
+		`INSERT INTO mailbox (id, recipient, sender, nick, ts, body) VALUES (?, ?, ?, ?, ?, ?)`,
+		msg.ID, msg.To, msg.From, msg.Nick, msg.Time.UnixNano(), msg.Body,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (h *SQLHistory) Take(user string) ([]*Message, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`SELECT id, sender, nick, ts, body FROM mailbox WHERE recipient = ? ORDER BY id`, user)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*Message
+	for rows.Next() {
+		msg := &Message{Type: TypeDirect, To: user}
+		var ts int64
+		if err := rows.Scan(&msg.ID, &msg.From, &msg.Nick, &ts, &msg.Body); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		msg.Time = time.Unix(0, ts).UTC()
+		msgs = append(msgs, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	if _, err := tx.Exec(`DELETE FROM mailbox WHERE recipient = ?`, user); err != nil {
+		return nil, err
+	}
+	return msgs, tx.Commit()
+}
+
+func (h *SQLHistory) Close() error {
+	return h.db.Close()
+}
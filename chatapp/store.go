@@ -0,0 +1,71 @@
+package main
+
+// Run never waits on the history store or the mailbox. It queues what it
+// wants of them and hands the whole queue to the store goroutine whenever
+// that is idle, so what piles up while one batch is written goes in the
+// next: chats that arrive together are appended, and synced to disk or
+// committed, together. Each batch then comes back to Run, which finishes its
+// jobs in order, so a message is only passed on and acked once it is stored.
+
+// storeJob is one thing for the store goroutine to do: append chat to the
+// history if it is set, else call do if it is set. done is then called
+// from Run with the error.
+type storeJob struct {
+	chat *Message
+	do   func() error
+	done func(err error)
+	err  error
+}
+
+// queueStore queues job for the store goroutine. It must only be called
+// from Run.
+func (s *Server) queueStore(job *storeJob) {
+	s.queued = append(s.queued, job)
+}
+
+// afterStore calls f from Run once everything queued so far is done. It
+// must only be called from Run.
+func (s *Server) afterStore(f func()) {
+	s.queueStore(&storeJob{done: func(error) { f() }})
+}
+
+// runStore is the store goroutine.
+func (s *Server) runStore() {
+	for batch := range s.toStore {
+		start := 0 // the first chat not appended yet
+		for i, job := range batch {
+			if job.chat != nil {
+				continue
+			}
+			s.appendChats(batch[start:i])
+			if job.do != nil {
+				job.err = job.do()
+			}
+			start = i + 1
+		}
+		s.appendChats(batch[start:])
+		s.stored <- batch
+	}
+}
+
+func (s *Server) appendChats(jobs []*storeJob) {
+	if len(jobs) == 0 {
+		return
+	}
+	chats := make([]*Message, len(jobs))
+	for i, job := range jobs {
+		chats[i] = job.chat
+	}
+	err := s.history.Append(chats...)
+	for _, job := range jobs {
+		job.err = err
+	}
+}
+
+// answer delivers msg to client unless it went away while its job was
+// queued. It must only be called from Run.
+func (s *Server) answer(client *Client, msg *Message) {
+	if s.clients[client] {
+		client.deliver(msg)
+	}
+}
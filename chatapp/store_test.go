@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// gatedHistory holds every Append until gate is closed and records how many
+// messages each one stored.
+type gatedHistory struct {
+	*MemoryHistory
+	gate chan struct{}
+
+	mu      sync.Mutex
+	batches []int
+}
+
+func (h *gatedHistory) Append(msgs ...*Message) error {
+	<-h.gate
+	h.mu.Lock()
+	h.batches = append(h.batches, len(msgs))
+	h.mu.Unlock()
+	return h.MemoryHistory.Append(msgs...)
+}
+
+func TestChatsAreStoredTogetherOffTheHub(t *testing.T) {
+	history := &gatedHistory{MemoryHistory: NewMemoryHistory(100), gate: make(chan struct{})}
+	ts := serveTest(t, NewServer(&GuestAuthenticator{}, history, NewMemoryMailbox(), 0))
+	conn := dialTest(t, ts, "", false)
+	log := readChats(conn)
+
+	const chats = 6
+	for i := range chats {
+		sendChat(t, conn, fmt.Sprint("chat ", i))
+	}
+	// Frames are handled in order, so who is answered after every chat was
+	// taken in, while the first is still being stored.
+	if err := conn.WriteJSON(&Message{Type: TypeWho, Room: DefaultRoom}); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "who is answered while the store is stuck", func() bool {
+		log.mu.Lock()
+		defer log.mu.Unlock()
+		return log.who != nil
+	})
+	if log.has("chat 0") {
+		t.Fatal("a chat was passed on before it was stored")
+	}
+
+	close(history.gate)
+	log.waitFor(t, fmt.Sprint("chat ", chats-1))
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	total := 0
+	for _, n := range history.batches {
+		total += n
+	}
+	if total != chats || len(history.batches) > 2 {
+		t.Errorf("chats were stored in batches %v, want %d in at most 2", history.batches, chats)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// registerAdmin mounts the moderation endpoints. They are guarded by a single
+// shared bearer token.
+func (us *UrlShortener) registerAdmin(mux *http.ServeMux, token string) {
+	mux.Handle("POST /admin/links/{key}/disable", requireToken(token, us.adminSetDisabled(true)))
+	mux.Handle("POST /admin/links/{key}/enable", requireToken(token, us.adminSetDisabled(false)))
+}
+
+func (us *UrlShortener) adminSetDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := us.requestDomain(r)
+		if err != nil {
+			writeAPIError(w, r, err)
+			return
+		}
+		link, err := us.store.Update(domain, r.PathValue("key"), func(l *Link) error {
+			l.Disabled = disabled
+			return nil
+		})
+		if err != nil {
+			writeAPIError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, us.linkResponse(r, link))
+	}
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]apiError{
+				"error": {Code: "unauthorized", Message: "missing or invalid admin token"},
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
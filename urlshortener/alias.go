@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	minAliasLength = 3
+	maxAliasLength = 32
+)
+
+var ErrInvalidAlias = errors.New("invalid alias")
+
+// reservedAliases would shadow routes or read as official links.
+var reservedAliases = map[string]bool{
+	"admin":   true,
+	"api":     true,
+	"help":    true,
+	"login":   true,
+	"logout":  true,
+	"short":   true,
+	"shorten": true,
+	"stats":   true,
+	"static":  true,
+}
+
+// validateAlias checks a user supplied vanity key. Aliases may only use
+// letters, digits, '-' and '_' so they stay readable and URL safe.
+func validateAlias(alias string) error {
+	if len(alias) < minAliasLength || len(alias) > maxAliasLength {
+		return fmt.Errorf("%w: must be %d to %d characters long", ErrInvalidAlias, minAliasLength, maxAliasLength)
+	}
+	for _, c := range alias {
+		if !isAliasChar(c) {
+			return fmt.Errorf("%w: %q is not allowed, use letters, digits, '-' or '_'", ErrInvalidAlias, c)
+		}
+	}
+	if reservedAliases[strings.ToLower(alias)] {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidAlias, alias)
+	}
+	return nil
+}
+
+func isAliasChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_'
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ClickEvent struct {
+	Domain    string    `json:"domain,omitempty"`
+	Key       string    `json:"key"`
+	Time      time.Time `json:"time"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IP        string    `json:"ip"` // truncated, see truncateIP
+}
+
+type linkStats struct {
+	total    int64
+	visitors map[string]struct{}
+	byDay    map[string]int64
+	byHour   map[string]int64
+}
+
+type Stats struct {
+	Domain         string           `json:"domain,omitempty"`
+	Key            string           `json:"key"`
+	TotalClicks    int64            `json:"total_clicks"`
+	UniqueVisitors int              `json:"unique_visitors"`
+	ByDay          map[string]int64 `json:"by_day"`
+	ByHour         map[string]int64 `json:"by_hour"`
+}
+
+// Analytics aggregates click events off the redirect path. Record never
+// blocks: events go through a buffered channel to a single worker, and are
+// dropped (and counted) when the worker falls behind.
+type Analytics struct {
+	events  chan ClickEvent
+	stats   map[string]*linkStats
+	log     io.Writer
+	dropped atomic.Uint64
+	mu      sync.RWMutex
+	wg      sync.WaitGroup
+}
+
+// NewAnalytics buffers up to bufferSize events. When clickLog is not nil every
+// event is also appended to it as a JSON line.
+func NewAnalytics(bufferSize int, clickLog io.Writer) *Analytics {
+	return &Analytics{
+		events: make(chan ClickEvent, bufferSize),
+		stats:  make(map[string]*linkStats),
+		log:    clickLog,
+	}
+}
+
+func (a *Analytics) Record(ev ClickEvent) {
+	select {
+	case a.events <- ev:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// Run consumes events until ctx is cancelled.
+func (a *Analytics) Run(ctx context.Context) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		var enc *json.Encoder
+		if a.log != nil {
+			enc = json.NewEncoder(a.log)
+		}
+		handle := func(ev ClickEvent) {
+			a.add(ev)
+			if enc != nil {
+				if err := enc.Encode(ev); err != nil {
+					log.Printf("Error writing click log: %v", err)
+				}
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				// Flush what is already buffered before giving up.
+				for len(a.events) > 0 {
+					handle(<-a.events)
+				}
+				if n := a.dropped.Load(); n > 0 {
+					log.Printf("Analytics dropped %d click events", n)
+				}
+				return
+			case ev := <-a.events:
+				handle(ev)
+			}
+		}
+	}()
+}
+
+// Replay rebuilds the stats from a click log written by Run, so they survive
+// a restart. Only events keep returns true for are counted. It must be called
+// before Run. A line that does not parse, such as one torn by a crash, is
+// skipped.
+func (a *Analytics) Replay(r io.Reader, keep func(ClickEvent) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	skipped := 0
+	for scanner.Scan() {
+		var ev ClickEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			skipped++
+			continue
+		}
+		if keep(ev) {
+			a.add(ev)
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d unreadable lines in the click log", skipped)
+	}
+	return scanner.Err()
+}
+
+// liveClicks is a Replay filter for the links in store. It drops clicks on
+// links that are gone and clicks made before a link was created, so a key
+// that was deleted and taken again does not inherit the old link's clicks.
+func liveClicks(store Store) func(ClickEvent) bool {
+	created := make(map[string]time.Time) // zero for links that are gone
+	return func(ev ClickEvent) bool {
+		id := linkID(ev.Domain, ev.Key)
+		t, seen := created[id]
+		if !seen {
+			if link, err := store.Get(ev.Domain, ev.Key); err == nil {
+				t = link.CreatedAt
+			}
+			created[id] = t
+		}
+		return !t.IsZero() && !ev.Time.Before(t)
+	}
+}
+
+// Forget drops the stats of a deleted link.
+func (a *Analytics) Forget(domain, key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.stats, linkID(domain, key))
+}
+
+// Wait blocks until the worker started by Run has flushed and stopped.
+func (a *Analytics) Wait() {
+	a.wg.Wait()
+}
+
+func (a *Analytics) add(ev ClickEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	id := linkID(ev.Domain, ev.Key)
+	s, ok := a.stats[id]
+	if !ok {
+		s = &linkStats{
+			visitors: make(map[string]struct{}),
+			byDay:    make(map[string]int64),
+			byHour:   make(map[string]int64),
+		}
+		a.stats[id] = s
+	}
+
+	t := ev.Time.UTC()
+	s.total++
+	s.visitors[visitorID(ev)] = struct{}{}
+	s.byDay[t.Format("2006-01-02")]++
+	s.byHour[t.Format("2006-01-02T15")]++
+}
+
+func (a *Analytics) Stats(domain, key string) Stats {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	st := Stats{
+		Domain: domain,
+		Key:    key,
+		ByDay:  make(map[string]int64),
+		ByHour: make(map[string]int64),
+	}
+	s, ok := a.stats[linkID(domain, key)]
+	if !ok {
+		return st
+	}
+	st.TotalClicks = s.total
+	st.UniqueVisitors = len(s.visitors)
+	for day, n := range s.byDay {
+		st.ByDay[day] = n
+	}
+	for hour, n := range s.byHour {
+		st.ByHour[hour] = n
+	}
+	return st
+}
+
+// visitorID identifies a visitor by truncated IP and user agent without
+// keeping either in the clear.
+func visitorID(ev ClickEvent) string {
+	sum := sha256.Sum256([]byte(ev.IP + "|" + ev.UserAgent))
+	return hex.EncodeToString(sum[:8])
+}
+
+func newClickEvent(link *Link, r *http.Request, now time.Time) ClickEvent {
+	return ClickEvent{
+		Domain:    link.Domain,
+		Key:       link.Key,
+		Time:      now,
+		Referrer:  r.Referer(),
+		UserAgent: r.UserAgent(),
+		IP:        truncateIP(clientIP(r)),
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// truncateIP zeroes the host part of an address (/24 for IPv4, /48 for IPv6)
+// so stored events cannot be tied back to a single client.
+func truncateIP(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+func (us *UrlShortener) HandleStats(w http.ResponseWriter, r *http.Request) {
+	domain, err := us.requestDomain(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := r.PathValue("key")
+	_, err = us.store.Get(domain, key)
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "loading short url failed", "domain", domain, "key", key, "err", err)
+		http.Error(w, "could not load short url", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(us.analytics.Stats(domain, key))
+}
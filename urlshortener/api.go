@@ -0,0 +1,334 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+type linkResponse struct {
+	*Link
+	ShortURL string `json:"short_url"`
+}
+
+type listResponse struct {
+	Links      []linkResponse `json:"links"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// importResponse reports how far an import got, also when it stopped early.
+type importResponse struct {
+	ImportResult
+	Error *apiError `json:"error,omitempty"`
+}
+
+type patchRequest struct {
+	URL *string `json:"url"`
+}
+
+func (us *UrlShortener) registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/v1/links", us.requireAPIKey(us.apiCreateLink))
+	mux.HandleFunc("GET /api/v1/links", us.requireAPIKey(us.apiListLinks))
+	mux.HandleFunc("GET /api/v1/links/{key}", us.requireAPIKey(us.apiGetLink))
+	mux.HandleFunc("PATCH /api/v1/links/{key}", us.requireAPIKey(us.apiPatchLink))
+	mux.HandleFunc("DELETE /api/v1/links/{key}", us.requireAPIKey(us.apiDeleteLink))
+	mux.HandleFunc("POST /api/v1/import", us.requireAPIKey(us.apiImport))
+	mux.HandleFunc("GET /api/v1/export", us.requireAPIKey(us.apiExport))
+	mux.HandleFunc("GET /api/v1/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPISpec)
+	})
+}
+
+func (us *UrlShortener) apiCreateLink(w http.ResponseWriter, r *http.Request) {
+	var req LinkRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	link, created, err := us.shortenClaimed(r, req)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	location := "/api/v1/links/" + link.Key
+	if link.Domain != "" {
+		location += "?domain=" + url.QueryEscape(link.Domain)
+	}
+	w.Header().Set("Location", location)
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, us.linkResponse(r, link))
+}
+
+func (us *UrlShortener) apiGetLink(w http.ResponseWriter, r *http.Request) {
+	domain, err := us.requestDomain(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	link, err := us.store.Get(domain, r.PathValue("key"))
+	if err == nil {
+		err = checkOwner(r, link)
+	}
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, us.linkResponse(r, link))
+}
+
+func (us *UrlShortener) apiPatchLink(w http.ResponseWriter, r *http.Request) {
+	domain, err := us.requestDomain(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var req patchRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if req.URL == nil || *req.URL == "" {
+		writeAPIError(w, r, fmt.Errorf("%w: url field is required", ErrInvalidRequest))
+		return
+	}
+	destination, err := us.checkURL(*req.URL, r.Host)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	link, err := us.store.Update(domain, r.PathValue("key"), func(l *Link) error {
+		if err := checkOwner(r, l); err != nil {
+			return err
+		}
+		l.URL = destination
+		return nil
+	})
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, us.linkResponse(r, link))
+}
+
+func (us *UrlShortener) apiDeleteLink(w http.ResponseWriter, r *http.Request) {
+	domain, err := us.requestDomain(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	key := r.PathValue("key")
+	link, err := us.store.Get(domain, key)
+	if err == nil {
+		err = checkOwner(r, link)
+	}
+	if err == nil {
+		err = us.store.Delete(domain, key)
+	}
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	us.analytics.Forget(domain, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (us *UrlShortener) apiListLinks(w http.ResponseWriter, r *http.Request) {
+	domain, err := us.requestDomain(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	q := r.URL.Query()
+	owner := q.Get("owner")
+	if key := apiKeyFrom(r); key != nil {
+		if owner != "" && owner != key.Owner {
+			writeAPIError(w, r, fmt.Errorf("%w: owner does not match the API key", ErrForbidden))
+			return
+		}
+		owner = key.Owner
+	}
+	limit := defaultPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			writeAPIError(w, r, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidRequest, maxPageSize))
+			return
+		}
+		limit = n
+	}
+
+	// Ask for one extra link to find out whether there is a next page.
+	links, err := us.store.List(domain, owner, q.Get("cursor"), limit+1)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	resp := listResponse{Links: make([]linkResponse, 0, len(links))}
+	if len(links) > limit {
+		links = links[:limit]
+		resp.NextCursor = links[limit-1].Key
+	}
+	for _, link := range links {
+		resp.Links = append(resp.Links, us.linkResponse(r, link))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// apiImport streams the request body into the store. The format comes from
+// ?format= or else the Content-Type, the conflict policy from ?on_conflict=.
+func (us *UrlShortener) apiImport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "json"
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/csv" {
+			format = "csv"
+		}
+	}
+	onConflict := q.Get("on_conflict")
+	if onConflict == "" {
+		onConflict = string(ConflictFail)
+	}
+	policy, err := parseConflictPolicy(onConflict)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	// Large imports outlast the server's read and write timeouts.
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	src, err := NewLinkReader(format, r.Body)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var (
+		owner string
+		quota *TokenBucket
+	)
+	if key := apiKeyFrom(r); key != nil {
+		owner, quota = key.Owner, key.quota
+	}
+	res, err := us.Import(src, policy, owner, quota, time.Now())
+	if err != nil {
+		status, e := apiErrorFor(w, r, err)
+		writeJSON(w, status, importResponse{ImportResult: res, Error: &e})
+		return
+	}
+	writeJSON(w, http.StatusOK, importResponse{ImportResult: res})
+}
+
+// apiExport streams every link the caller owns, or every link when the
+// shortener runs without API keys, as CSV or JSON lines.
+func (us *UrlShortener) apiExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	case "json":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	dst, err := NewLinkWriter(format, w)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="links.`+format+`"`)
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	var owner string
+	if key := apiKeyFrom(r); key != nil {
+		owner = key.Owner
+	}
+	// Once the first bytes are out an error can only end the stream early.
+	if _, err := us.Export(dst, owner); err != nil {
+		slog.ErrorContext(r.Context(), "export stopped", "err", err)
+	}
+}
+
+func (us *UrlShortener) linkResponse(r *http.Request, link *Link) linkResponse {
+	return linkResponse{Link: link, ShortURL: us.domains.ShortURL(r, link.Domain, link.Key)}
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: malformed JSON body: %v", ErrInvalidRequest, err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// writeAPIError renders err as {"error": {"code": ..., "message": ...}}.
+// Internal errors are logged and replaced by a generic message.
+func writeAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	status, e := apiErrorFor(w, r, err)
+	writeJSON(w, status, map[string]apiError{"error": e})
+}
+
+func apiErrorFor(w http.ResponseWriter, r *http.Request, err error) (int, apiError) {
+	status := errorStatus(err)
+	e := apiError{Message: err.Error()}
+	switch status {
+	case http.StatusBadRequest:
+		e.Code = "invalid_request"
+	case http.StatusUnauthorized:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		e.Code = "unauthorized"
+	case http.StatusForbidden:
+		e.Code = "forbidden"
+	case http.StatusNotFound:
+		e.Code, e.Message = "not_found", ErrNotFound.Error()
+	case http.StatusConflict:
+		e.Code = "conflict"
+	case http.StatusGone:
+		e.Code = "gone"
+	case http.StatusTooManyRequests:
+		e.Code = "rate_limited"
+	default:
+		slog.ErrorContext(r.Context(), "api request failed", "err", err)
+		e.Code, e.Message = "internal", "internal server error"
+	}
+	return status, e
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnauthorized  = errors.New("missing or invalid API key")
+	ErrForbidden     = errors.New("forbidden")
+	ErrQuotaExceeded = errors.New("link creation quota exceeded")
+)
+
+// APIKey ties a key to the owner of the links created with it. quota limits
+// how many links the key may create.
+type APIKey struct {
+	Owner string
+	quota *TokenBucket
+}
+
+// APIKeys looks keys up by their SHA-256, so the lookup does not leak through
+// timing how much of a key matched.
+type APIKeys struct {
+	keys map[[sha256.Size]byte]*APIKey
+}
+
+// LoadAPIKeys reads one key per line: the key, its owner and optionally the
+// number of links it may create per quotaInterval, separated by whitespace.
+// Keys without their own number get defaultQuota. Both defaultQuota and
+// quotaInterval must be positive. Blank lines and lines starting with '#'
+// are ignored.
+func LoadAPIKeys(path string, defaultQuota int, quotaInterval time.Duration) (*APIKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open api keys: %w", err)
+	}
+	defer f.Close()
+
+	ak := &APIKeys{keys: make(map[[sha256.Size]byte]*APIKey)}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("api keys line %d: want \"key owner [quota]\"", line)
+		}
+		quota := defaultQuota
+		if len(fields) == 3 {
+			if quota, err = strconv.Atoi(fields[2]); err != nil || quota < 1 {
+				return nil, fmt.Errorf("api keys line %d: quota must be a positive integer", line)
+			}
+		}
+		sum := sha256.Sum256([]byte(fields[0]))
+		if _, ok := ak.keys[sum]; ok {
+			return nil, fmt.Errorf("api keys line %d: duplicate key", line)
+		}
+		ak.keys[sum] = &APIKey{
+			Owner: fields[1],
+			quota: NewTokenBucket(quota, max(quotaInterval/time.Duration(quota), time.Nanosecond)),
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read api keys: %w", err)
+	}
+	return ak, nil
+}
+
+func (ak *APIKeys) Lookup(key string) (*APIKey, bool) {
+	k, ok := ak.keys[sha256.Sum256([]byte(key))]
+	return k, ok
+}
+
+type apiKeyContextKey struct{}
+
+// requireAPIKey rejects requests without a valid "Authorization: Bearer"
+// key and passes the key on in the request context. Without configured keys
+// the shortener is open and every request goes through anonymously.
+func (us *UrlShortener) requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	if us.apiKeys == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			writeAPIError(w, r, ErrUnauthorized)
+			return
+		}
+		key, ok := us.apiKeys.Lookup(got)
+		if !ok {
+			writeAPIError(w, r, ErrUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+// apiKeyFrom returns the key that authenticated r, or nil when the shortener
+// runs without keys.
+func apiKeyFrom(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// claimLink makes the caller's key the owner of the link req describes and
+// takes a link from the key's quota. The returned key is nil when the
+// shortener runs without keys; otherwise the caller must give the link back
+// with key.quota.Return unless one was actually created.
+func claimLink(r *http.Request, req *LinkRequest) (*APIKey, error) {
+	key := apiKeyFrom(r)
+	if key == nil {
+		return nil, nil
+	}
+	if req.Owner != "" && req.Owner != key.Owner {
+		return nil, fmt.Errorf("%w: owner does not match the API key", ErrForbidden)
+	}
+	req.Owner = key.Owner
+	if !key.quota.Allow() {
+		return nil, ErrQuotaExceeded
+	}
+	return key, nil
+}
+
+// shortenClaimed is Shorten on behalf of the caller's API key. Only a link
+// that was created counts against the quota; invalid requests and links
+// handed out again by dedup are free.
+func (us *UrlShortener) shortenClaimed(r *http.Request, req LinkRequest) (*Link, bool, error) {
+	key, err := claimLink(r, &req)
+	if err != nil {
+		return nil, false, err
+	}
+	link, created, err := us.Shorten(req, r.Host, time.Now())
+	if key != nil && !created {
+		key.quota.Return()
+	}
+	return link, created, err
+}
+
+// checkOwner reports whether the caller may manage link.
+func checkOwner(r *http.Request, link *Link) error {
+	if key := apiKeyFrom(r); key != nil && link.Owner != key.Owner {
+		return fmt.Errorf("%w: link belongs to another owner", ErrForbidden)
+	}
+	return nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConflictPolicy decides what an import does with a key that already exists.
+type ConflictPolicy string
+
+const (
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictFail      ConflictPolicy = "fail"
+)
+
+const maxImportedKeyLength = 64
+
+func parseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+		return p, nil
+	default:
+		return "", fmt.Errorf("%w: conflict policy must be skip, overwrite or fail", ErrInvalidRequest)
+	}
+}
+
+// csvColumns is the export layout. Imports need key and url; the other
+// columns are optional and may come in any order.
+var csvColumns = []string{"domain", "key", "url", "owner", "created_at", "expires_at", "max_clicks", "clicks", "disabled"}
+
+// LinkReader yields the links of an import one at a time; Next returns
+// io.EOF after the last one.
+type LinkReader interface {
+	Next() (*Link, error)
+}
+
+// LinkWriter streams an export.
+type LinkWriter interface {
+	Write(link *Link) error
+	Flush() error
+}
+
+func NewLinkReader(format string, r io.Reader) (LinkReader, error) {
+	switch format {
+	case "csv":
+		return newCSVLinkReader(r)
+	case "json":
+		return newJSONLinkReader(r)
+	default:
+		return nil, fmt.Errorf("%w: format must be csv or json", ErrInvalidRequest)
+	}
+}
+
+func NewLinkWriter(format string, w io.Writer) (LinkWriter, error) {
+	switch format {
+	case "csv":
+		return newCSVLinkWriter(w)
+	case "json":
+		return &jsonLinkWriter{w: bufio.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("%w: format must be csv or json", ErrInvalidRequest)
+	}
+}
+
+type csvLinkReader struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+func newCSVLinkReader(r io.Reader) (*csvLinkReader, error) {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading csv header: %v", ErrInvalidRequest, err)
+	}
+
+	known := make(map[string]bool)
+	for _, c := range csvColumns {
+		known[c] = true
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !known[name] {
+			return nil, fmt.Errorf("%w: unknown csv column %q", ErrInvalidRequest, name)
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["key"]; !ok {
+		return nil, fmt.Errorf("%w: csv header needs a key column", ErrInvalidRequest)
+	}
+	if _, ok := columns["url"]; !ok {
+		return nil, fmt.Errorf("%w: csv header needs a url column", ErrInvalidRequest)
+	}
+	return &csvLinkReader{r: cr, columns: columns}, nil
+}
+
+func (cr *csvLinkReader) Next() (*Link, error) {
+	record, err := cr.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	field := func(name string) string {
+		if i, ok := cr.columns[name]; ok {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	link := &Link{
+		Domain: field("domain"),
+		Key:    field("key"),
+		URL:    field("url"),
+		Owner:  field("owner"),
+	}
+	if v := field("created_at"); v != "" {
+		if link.CreatedAt, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errors.New("created_at must be an RFC 3339 timestamp")
+		}
+	}
+	if v := field("expires_at"); v != "" {
+		if link.ExpiresAt, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errors.New("expires_at must be an RFC 3339 timestamp")
+		}
+	}
+	if v := field("max_clicks"); v != "" {
+		if link.MaxClicks, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.New("max_clicks must be an integer")
+		}
+	}
+	if v := field("clicks"); v != "" {
+		if link.Clicks, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.New("clicks must be an integer")
+		}
+	}
+	if v := field("disabled"); v != "" {
+		if link.Disabled, err = strconv.ParseBool(v); err != nil {
+			return nil, errors.New("disabled must be true or false")
+		}
+	}
+	return link, nil
+}
+
+// jsonLinkReader accepts links as a JSON array or as a stream of objects,
+// one per line or otherwise, without loading the whole input.
+type jsonLinkReader struct {
+	dec     *json.Decoder
+	inArray bool
+}
+
+func newJSONLinkReader(r io.Reader) (*jsonLinkReader, error) {
+	br := bufio.NewReader(r)
+	jr := &jsonLinkReader{}
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+		jr.inArray = c == '['
+		br.UnreadByte()
+		break
+	}
+	jr.dec = json.NewDecoder(br)
+	jr.dec.DisallowUnknownFields()
+	if jr.inArray {
+		if _, err := jr.dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return jr, nil
+}
+
+func (jr *jsonLinkReader) Next() (*Link, error) {
+	if jr.inArray && !jr.dec.More() {
+		// The closing bracket.
+		if _, err := jr.dec.Token(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	var link Link
+	if err := jr.dec.Decode(&link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+type csvLinkWriter struct {
+	w *csv.Writer
+}
+
+func newCSVLinkWriter(w io.Writer) (*csvLinkWriter, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvColumns); err != nil {
+		return nil, err
+	}
+	return &csvLinkWriter{w: cw}, nil
+}
+
+func (cw *csvLinkWriter) Write(link *Link) error {
+	var expiresAt string
+	if !link.ExpiresAt.IsZero() {
+		expiresAt = link.ExpiresAt.Format(time.RFC3339)
+	}
+	return cw.w.Write([]string{
+		link.Domain,
+		link.Key,
+		link.URL,
+		link.Owner,
+		link.CreatedAt.Format(time.RFC3339),
+		expiresAt,
+		strconv.FormatInt(link.MaxClicks, 10),
+		strconv.FormatInt(link.Clicks, 10),
+		strconv.FormatBool(link.Disabled),
+	})
+}
+
+func (cw *csvLinkWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// jsonLinkWriter writes one link per line.
+type jsonLinkWriter struct {
+	w *bufio.Writer
+}
+
+func (jw *jsonLinkWriter) Write(link *Link) error {
+	data, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	jw.w.Write(data)
+	return jw.w.WriteByte('\n')
+}
+
+func (jw *jsonLinkWriter) Flush() error {
+	return jw.w.Flush()
+}
+
+// ImportResult counts what an import did with the records it read.
+type ImportResult struct {
+	Created     int `json:"created"`
+	Overwritten int `json:"overwritten"`
+	Skipped     int `json:"skipped"`
+}
+
+// importBatchSize is how many records an import reads and checks before
+// writing them in one store batch.
+const importBatchSize = 1000
+
+// Import stores every link src yields. Links are checked like the ones made
+// through Shorten, except that imported keys only have to be URL safe: they
+// were handed out by another shortener and are already in use. When owner is
+// set every link is imported for that owner and may only overwrite that
+// owner's links. When quota is not nil every created link takes a token from
+// it; overwritten and skipped links are free.
+//
+// An import is not a transaction. It stops at the first bad record, or at
+// the first conflict under ConflictFail, and the links stored before stay;
+// running it again with ConflictSkip picks up where it stopped.
+func (us *UrlShortener) Import(src LinkReader, policy ConflictPolicy, owner string, quota *TokenBucket, now time.Time) (ImportResult, error) {
+	var res ImportResult
+	links := make([]*Link, 0, importBatchSize)
+	for first := 1; ; first += len(links) {
+		// Records are read before the batch starts, so a slow upload does
+		// not hold up other writers.
+		links = links[:0]
+		var readErr error
+		for len(links) < importBatchSize {
+			n := first + len(links)
+			link, err := src.Next()
+			if err == io.EOF {
+				readErr = err
+				break
+			}
+			if err != nil {
+				readErr = fmt.Errorf("%w: record %d: %v", ErrInvalidRequest, n, err)
+				break
+			}
+			if err := us.checkImported(link, owner, now); err != nil {
+				readErr = fmt.Errorf("record %d: %w", n, err)
+				break
+			}
+			links = append(links, link)
+		}
+
+		if len(links) > 0 {
+			err := batchWrites(us.store, func(b LinkBatch) error {
+				for i, link := range links {
+					if err := importLink(b, link, policy, owner, quota, &res); err != nil {
+						return fmt.Errorf("record %d: %w", first+i, err)
+					}
+				}
+				return nil
+			})
+			// Whatever part of the batch got stored is taken, even if the
+			// batch failed.
+			if obs, ok := us.keygen.(keyObserver); ok {
+				for _, link := range links {
+					obs.Observe(link.Key)
+				}
+			}
+			if err != nil {
+				return res, err
+			}
+		}
+		if readErr == io.EOF {
+			return res, nil
+		}
+		if readErr != nil {
+			return res, readErr
+		}
+	}
+}
+
+// importLink stores one checked link. A key that already exists goes to the
+// conflict policy even when quota is used up.
+func importLink(b LinkBatch, link *Link, policy ConflictPolicy, owner string, quota *TokenBucket, res *ImportResult) error {
+	var err error
+	if quota == nil || quota.Allow() {
+		err = b.Create(link)
+		if err == nil {
+			res.Created++
+			return nil
+		}
+		if quota != nil {
+			quota.Return()
+		}
+	} else if _, err = b.Get(link.Domain, link.Key); err == nil {
+		err = ErrKeyExists
+	} else if errors.Is(err, ErrNotFound) {
+		return ErrQuotaExceeded
+	}
+	if !errors.Is(err, ErrKeyExists) {
+		return err
+	}
+
+	switch policy {
+	case ConflictSkip:
+		res.Skipped++
+	case ConflictFail:
+		return fmt.Errorf("%w: %q", ErrKeyExists, link.Key)
+	case ConflictOverwrite:
+		_, err := b.Update(link.Domain, link.Key, func(l *Link) error {
+			if owner != "" && l.Owner != owner {
+				return fmt.Errorf("%w: link belongs to another owner", ErrForbidden)
+			}
+			clicks := l.Clicks
+			*l = *link
+			l.Clicks = clicks
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		res.Overwritten++
+	}
+	return nil
+}
+
+func (us *UrlShortener) checkImported(link *Link, owner string, now time.Time) error {
+	if link.Key == "" || len(link.Key) > maxImportedKeyLength {
+		return fmt.Errorf("%w: key must be 1 to %d characters long", ErrInvalidRequest, maxImportedKeyLength)
+	}
+	for _, c := range link.Key {
+		if !isAliasChar(c) {
+			return fmt.Errorf("%w: key %q may only use letters, digits, '-' or '_'", ErrInvalidRequest, link.Key)
+		}
+	}
+	domain, err := us.domains.Lookup(link.Domain)
+	if err != nil {
+		return err
+	}
+	link.Domain = domain
+	if link.URL, err = us.checkURL(link.URL, ""); err != nil {
+		return err
+	}
+	if owner != "" {
+		if link.Owner != "" && link.Owner != owner {
+			return fmt.Errorf("%w: owner does not match the API key", ErrForbidden)
+		}
+		link.Owner = owner
+	}
+	if link.MaxClicks < 0 || link.Clicks < 0 {
+		return fmt.Errorf("%w: max_clicks and clicks must not be negative", ErrInvalidRequest)
+	}
+	if link.CreatedAt.IsZero() {
+		link.CreatedAt = now
+	}
+	link.CreatedAt = link.CreatedAt.UTC()
+	if !link.ExpiresAt.IsZero() {
+		link.ExpiresAt = link.ExpiresAt.UTC()
+	}
+	return nil
+}
+
+// Export writes every link, or every link of owner, to dst. Dead links are
+// included; the sweeper decides when they go, not the export.
+func (us *UrlShortener) Export(dst LinkWriter, owner string) (int, error) {
+	n := 0
+	err := us.store.Walk(func(link *Link) error {
+		if owner != "" && link.Owner != owner {
+			return nil
+		}
+		n++
+		return dst.Write(link)
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, dst.Flush()
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type cacheItem struct {
+	key       string
+	link      *Link // nil caches "not found"
+	expiresAt time.Time
+}
+
+// genStripes is how many invalidation counters keys are spread over.
+const genStripes = 256
+
+// LRUCache is the LRU with TTL from cache/singlenodecache.go, holding links.
+// Get moves entries to the front, so it takes the write lock.
+//
+// gens counts the invalidations of each stripe of keys. A caller filling the
+// cache from the backing store takes the key's generation before the read and
+// passes it to SetIfUnchanged, so a value read before a concurrent Remove is
+// never cached after it.
+type LRUCache struct {
+	capacity  int
+	evictList *list.List
+	items     map[string]*list.Element
+	gens      [genStripes]uint64
+	mu        sync.Mutex
+}
+
+func NewLRUCache(capacity int) *LRUCache {
+	return &LRUCache{
+		capacity:  capacity,
+		evictList: list.New(),
+		items:     make(map[string]*list.Element),
+	}
+}
+
+func (l *LRUCache) Set(key string, link *Link, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.set(key, link, ttl)
+}
+
+func (l *LRUCache) set(key string, link *Link, ttl time.Duration) {
+	if el, ok := l.items[key]; ok {
+		l.evictList.MoveToFront(el)
+		el.Value.(*cacheItem).link = link
+		el.Value.(*cacheItem).expiresAt = time.Now().Add(ttl)
+		return
+	}
+
+	if l.evictList.Len() >= l.capacity {
+		l.evict()
+	}
+
+	item := &cacheItem{key: key, link: link, expiresAt: time.Now().Add(ttl)}
+	l.items[key] = l.evictList.PushFront(item)
+}
+
+// Generation returns the invalidation count SetIfUnchanged checks for key.
+func (l *LRUCache) Generation(key string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.gens[genStripe(key)]
+}
+
+// SetIfUnchanged caches link unless key was removed or the cache purged since
+// gen was taken from Generation.
+func (l *LRUCache) SetIfUnchanged(key string, link *Link, ttl time.Duration, gen uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.gens[genStripe(key)] != gen {
+		return
+	}
+	l.set(key, link, ttl)
+}
+
+func genStripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % genStripes)
+}
+
+// Get reports whether key is cached; a cached miss comes back as (nil, true).
+func (l *LRUCache) Get(key string) (*Link, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(el.Value.(*cacheItem).expiresAt) {
+		l.removeElement(el)
+		return nil, false
+	}
+	l.evictList.MoveToFront(el)
+	return el.Value.(*cacheItem).link, true
+}
+
+func (l *LRUCache) Remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.gens[genStripe(key)]++
+	if el, ok := l.items[key]; ok {
+		l.removeElement(el)
+	}
+}
+
+func (l *LRUCache) Purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := range l.gens {
+		l.gens[i]++
+	}
+	l.evictList.Init()
+	l.items = make(map[string]*list.Element)
+}
+
+func (l *LRUCache) evict() {
+	el := l.evictList.Back()
+	if el != nil {
+		l.removeElement(el)
+	}
+}
+
+func (l *LRUCache) removeElement(el *list.Element) {
+	delete(l.items, el.Value.(*cacheItem).key)
+	l.evictList.Remove(el)
+}
+
+type CacheStats struct {
+	Hits         uint64  `json:"hits"`
+	NegativeHits uint64  `json:"negative_hits"`
+	Misses       uint64  `json:"misses"`
+	HitRate      float64 `json:"hit_rate"`
+	// DroppedClicks were not counted because the click queue was full.
+	DroppedClicks uint64 `json:"dropped_clicks"`
+}
+
+// CachingStore is a read-through cache in front of another Store for the
+// redirect path. Hit on an unlimited link is answered from the cache and its
+// click is counted in the backing store by a background worker, so the
+// redirect never waits on storage. Links with a click limit always go to the
+// backing store, which owns the atomic limit check. Get still reads the
+// backing store so the API never shows stale click counts, and every write
+// through the CachingStore invalidates the affected key.
+type CachingStore struct {
+	Store
+	cache       *LRUCache
+	ttl         time.Duration
+	negativeTTL time.Duration
+	clicks      chan Link
+
+	hits, negativeHits, misses atomic.Uint64
+	droppedClicks              atomic.Uint64
+	wg                         sync.WaitGroup
+}
+
+func NewCachingStore(store Store, capacity int, ttl, negativeTTL time.Duration) *CachingStore {
+	cs := &CachingStore{
+		Store:       store,
+		cache:       NewLRUCache(capacity),
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		clicks:      make(chan Link, 4096),
+	}
+	cs.wg.Add(1)
+	go cs.countClicks()
+	return cs
+}
+
+func (cs *CachingStore) countClicks() {
+	defer cs.wg.Done()
+	for link := range cs.clicks {
+		if _, err := cs.Store.Hit(link.Domain, link.Key, time.Now()); err != nil && !errors.Is(err, ErrLinkGone) && !errors.Is(err, ErrNotFound) {
+			log.Printf("Error counting click for %q: %v", link.ID(), err)
+		}
+	}
+}
+
+func (cs *CachingStore) lookup(domain, key string) (*Link, error) {
+	id := linkID(domain, key)
+	if link, ok := cs.cache.Get(id); ok {
+		if link == nil {
+			cs.negativeHits.Add(1)
+			return nil, ErrNotFound
+		}
+		cs.hits.Add(1)
+		return link, nil
+	}
+
+	cs.misses.Add(1)
+	gen := cs.cache.Generation(id)
+	link, err := cs.Store.Get(domain, key)
+	if errors.Is(err, ErrNotFound) {
+		cs.cache.SetIfUnchanged(id, nil, cs.negativeTTL, gen)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	cs.cache.SetIfUnchanged(id, link, cs.ttl, gen)
+	return link, nil
+}
+
+func (cs *CachingStore) Hit(domain, key string, now time.Time) (*Link, error) {
+	link, err := cs.lookup(domain, key)
+	if err != nil {
+		return nil, err
+	}
+	if link.MaxClicks > 0 {
+		id := link.ID()
+		gen := cs.cache.Generation(id)
+		link, err := cs.Store.Hit(domain, key, now)
+		if err == nil {
+			cs.cache.SetIfUnchanged(id, link, cs.ttl, gen)
+		}
+		return link, err
+	}
+
+	if link.Disabled {
+		return nil, ErrLinkDisabled
+	}
+	if link.Dead(now) {
+		return nil, ErrLinkGone
+	}
+	select {
+	case cs.clicks <- Link{Domain: domain, Key: key}:
+	default:
+		// Logging each one would only add to the load that filled the queue.
+		cs.droppedClicks.Add(1)
+	}
+	l := *link
+	return &l, nil
+}
+
+func (cs *CachingStore) Create(link *Link) error {
+	err := cs.Store.Create(link)
+	cs.cache.Remove(link.ID())
+	return err
+}
+
+func (cs *CachingStore) Update(domain, key string, fn func(*Link) error) (*Link, error) {
+	link, err := cs.Store.Update(domain, key, fn)
+	cs.cache.Remove(linkID(domain, key))
+	return link, err
+}
+
+func (cs *CachingStore) Delete(domain, key string) error {
+	err := cs.Store.Delete(domain, key)
+	cs.cache.Remove(linkID(domain, key))
+	return err
+}
+
+// cachingBatch remembers every key written through the batch, so they can
+// be invalidated once the writes are durable and visible to readers.
+type cachingBatch struct {
+	LinkBatch
+	written []string
+}
+
+func (b *cachingBatch) Create(link *Link) error {
+	b.written = append(b.written, link.ID())
+	return b.LinkBatch.Create(link)
+}
+
+func (b *cachingBatch) Update(domain, key string, fn func(*Link) error) (*Link, error) {
+	b.written = append(b.written, linkID(domain, key))
+	return b.LinkBatch.Update(domain, key, fn)
+}
+
+func (cs *CachingStore) Batch(fn func(LinkBatch) error) error {
+	var cb *cachingBatch
+	err := batchWrites(cs.Store, func(b LinkBatch) error {
+		cb = &cachingBatch{LinkBatch: b}
+		return fn(cb)
+	})
+	if cb != nil {
+		for _, id := range cb.written {
+			cs.cache.Remove(id)
+		}
+	}
+	return err
+}
+
+func (cs *CachingStore) PurgeDead(now time.Time) ([]*Link, error) {
+	purged, err := cs.Store.PurgeDead(now)
+	if len(purged) > 0 {
+		cs.cache.Purge()
+	}
+	return purged, err
+}
+
+func (cs *CachingStore) Stats() CacheStats {
+	st := CacheStats{
+		Hits:          cs.hits.Load(),
+		NegativeHits:  cs.negativeHits.Load(),
+		Misses:        cs.misses.Load(),
+		DroppedClicks: cs.droppedClicks.Load(),
+	}
+	if total := st.Hits + st.NegativeHits + st.Misses; total > 0 {
+		st.HitRate = float64(st.Hits+st.NegativeHits) / float64(total)
+	}
+	return st
+}
+
+// Close drains the pending click counts before closing the backing store.
+func (cs *CachingStore) Close() error {
+	close(cs.clicks)
+	cs.wg.Wait()
+	if n := cs.droppedClicks.Load(); n > 0 {
+		log.Printf("Click counter dropped %d clicks", n)
+	}
+	return cs.Store.Close()
+}
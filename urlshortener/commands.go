@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// storeFlags and checkFlags are shared by the server and the import and
+// export commands, so all of them find the same links and judge URLs the
+// same way.
+type storeFlags struct {
+	kind, path, driver *string
+}
+
+func addStoreFlags(fs *flag.FlagSet) storeFlags {
+	return storeFlags{
+		kind:   fs.String("store", "memory", "link store: memory, file or sql"),
+		path:   fs.String("store-path", "links.log", "log file for the file store, DSN for the sql store"),
+		driver: fs.String("sql-driver", "sqlite", "database/sql driver name for the sql store"),
+	}
+}
+
+func (sf storeFlags) open() (Store, error) {
+	return openStore(*sf.kind, *sf.path, *sf.driver)
+}
+
+// openPersistent is open for the import and export commands, which would
+// only work on an empty store that is thrown away on exit with -store memory.
+func (sf storeFlags) openPersistent() (Store, error) {
+	if *sf.kind == "memory" {
+		return nil, errors.New("the memory store does not outlive the command; pass -store file or -store sql")
+	}
+	return sf.open()
+}
+
+type checkFlags struct {
+	blocklist, baseURL, domains *string
+}
+
+func addCheckFlags(fs *flag.FlagSet) checkFlags {
+	return checkFlags{
+		blocklist: fs.String("blocklist", "", "file with blocked domains and regex: patterns"),
+		baseURL:   fs.String("base-url", "", "public base URL of short links, e.g. https://sho.rt (default: http:// and the request host)"),
+		domains:   fs.String("domains", "", "comma separated branded domains, each with its own short keys"),
+	}
+}
+
+func (cf checkFlags) load() (Blocklist, *Domains, error) {
+	blocklist := NewRuleBlocklist()
+	if *cf.blocklist != "" {
+		var err error
+		if blocklist, err = LoadBlocklist(*cf.blocklist); err != nil {
+			return nil, nil, err
+		}
+	}
+	domains, err := NewDomains(*cf.baseURL, strings.Split(*cf.domains, ","))
+	if err != nil {
+		return nil, nil, err
+	}
+	return blocklist, domains, nil
+}
+
+// runCommand runs the subcommand named by args[0], if there is one, and
+// reports whether it did.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "import":
+		runImport(args[1:])
+	case "export":
+		runExport(args[1:])
+	default:
+		return false
+	}
+	return true
+}
+
+// parseCommandFlags parses a subcommand's flags, environment included, and
+// leaves the positional arguments in fs.Args.
+func parseCommandFlags(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	if err := applyEnv(fs); err != nil {
+		log.Fatal("Error reading environment: ", err)
+	}
+}
+
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: urlshortener import [flags] FILE (- for stdin)")
+		fs.PrintDefaults()
+	}
+	sf := addStoreFlags(fs)
+	cf := addCheckFlags(fs)
+	format := fs.String("format", "csv", "input format: csv or json")
+	onConflict := fs.String("on-conflict", "fail", "what to do with keys that already exist: skip, overwrite or fail")
+	owner := fs.String("owner", "", "import every link for this owner")
+	parseCommandFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	policy, err := parseConflictPolicy(*onConflict)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal("Error opening import file: ", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	src, err := NewLinkReader(*format, in)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	blocklist, domains, err := cf.load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := sf.openPersistent()
+	if err != nil {
+		log.Fatal("Error opening store: ", err)
+	}
+	shortener := NewUrlShortener(store, nil, nil, blocklist, domains, nil, nil, false)
+
+	start := time.Now()
+	res, err := shortener.Import(src, policy, *owner, nil, start)
+	closeErr := store.Close()
+	fmt.Fprintf(os.Stderr, "created %d, overwritten %d, skipped %d in %s\n",
+		res.Created, res.Overwritten, res.Skipped, time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		log.Fatal("Import stopped: ", err)
+	}
+	if closeErr != nil {
+		log.Fatal("Error closing store: ", closeErr)
+	}
+}
+
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	sf := addStoreFlags(fs)
+	format := fs.String("format", "csv", "output format: csv or json")
+	output := fs.String("o", "-", "file to write, - for stdout")
+	owner := fs.String("owner", "", "only export the links of this owner")
+	parseCommandFlags(fs, args)
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal("Error creating export file: ", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	dst, err := NewLinkWriter(*format, out)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := sf.openPersistent()
+	if err != nil {
+		log.Fatal("Error opening store: ", err)
+	}
+	defer store.Close()
+	shortener := NewUrlShortener(store, nil, nil, nil, nil, nil, nil, false)
+
+	n, err := shortener.Export(dst, *owner)
+	if err != nil {
+		log.Fatal("Export stopped: ", err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d links\n", n)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Domains knows which hosts the shortener answers on and how to build the
+// public short URL for a link. Every branded domain has its own key space;
+// any other host is the default domain, stored as "" on the link.
+type Domains struct {
+	base    *url.URL // public URL of the default domain; nil means the request host over http
+	branded map[string]bool
+}
+
+// NewDomains parses the public base URL (scheme, host and an optional path
+// prefix, e.g. "https://sho.rt" or "https://example.com/s") and the list of
+// branded domains. Branded domains are served with the base URL's scheme.
+func NewDomains(baseURL string, branded []string) (*Domains, error) {
+	d := &Domains{branded: make(map[string]bool)}
+	if baseURL != "" {
+		u, err := url.Parse(baseURL)
+		if err != nil || !allowedSchemes[u.Scheme] || u.Host == "" {
+			return nil, fmt.Errorf("base url %q must be an absolute http or https URL", baseURL)
+		}
+		if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return nil, fmt.Errorf("base url %q must not have a query, fragment or credentials", baseURL)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		d.base = u
+	}
+	for _, name := range branded {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if strings.ContainsAny(name, ":/") {
+			return nil, fmt.Errorf("domain %q must be a bare host name", name)
+		}
+		d.branded[name] = true
+	}
+	return d, nil
+}
+
+// Resolve maps the Host of an incoming request to the domain its keys live in.
+func (d *Domains) Resolve(host string) string {
+	name := strings.ToLower(hostname(host))
+	if d.branded[name] {
+		return name
+	}
+	return ""
+}
+
+// Lookup validates a domain named explicitly by an API client. The default
+// domain may be given by its base URL host.
+func (d *Domains) Lookup(name string) (string, error) {
+	name = strings.ToLower(name)
+	if d.branded[name] {
+		return name, nil
+	}
+	if name == "" || (d.base != nil && sameHost(name, d.base.Host)) {
+		return "", nil
+	}
+	return "", fmt.Errorf("%w: unknown domain %q", ErrInvalidRequest, name)
+}
+
+// Serves reports whether host is one of the configured public hosts.
+func (d *Domains) Serves(host string) bool {
+	if d.base != nil && sameHost(host, d.base.Host) {
+		return true
+	}
+	return d.branded[strings.ToLower(hostname(host))]
+}
+
+// ShortURL returns the public URL of key in domain. Without a configured base
+// URL the default domain falls back to the host the request came in on.
+func (d *Domains) ShortURL(r *http.Request, domain, key string) string {
+	scheme := "http"
+	if d.base != nil {
+		scheme = d.base.Scheme
+	}
+	switch {
+	case domain != "":
+		return scheme + "://" + domain + "/short/" + key
+	case d.base != nil:
+		return d.base.String() + "/short/" + key
+	default:
+		return "http://" + r.Host + "/short/" + key
+	}
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
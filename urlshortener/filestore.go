@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// logRecord is a single line of the append-only log. The log is replayed in
+// order on startup to rebuild the in-memory index. "create" and "update"
+// carry the whole link, "hit" and "delete" only its domain and key.
+type logRecord struct {
+	Op     string `json:"op"`
+	Link   *Link  `json:"link,omitempty"`
+	Domain string `json:"domain,omitempty"`
+	Key    string `json:"key,omitempty"`
+}
+
+// compactMinRecords is the log length below which the log is never
+// compacted, so small stores are not rewritten over and over.
+const compactMinRecords = 10000
+
+// FileStore keeps every link in memory and appends each mutation to a log
+// file, so links survive restarts without an external database. Every
+// redirect adds a record, so once the log holds more than twice as many
+// records as there are links it is rewritten as one create per link.
+type FileStore struct {
+	mem     *MemoryStore
+	path    string
+	file    *os.File
+	w       *bufio.Writer
+	records int // lines in the log
+	mu      sync.Mutex
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open store file: %w", err)
+	}
+
+	fs := &FileStore{
+		mem:  NewMemoryStore(),
+		path: path,
+		file: file,
+		w:    bufio.NewWriter(file),
+	}
+	if err := fs.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := fs.maybeCompact(); err != nil {
+		fs.file.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// replay applies the log to the in-memory index. A crash or a full disk in
+// the middle of append leaves a torn last line, which is cut off so the
+// store opens again; a bad line anywhere else is corruption and an error.
+func (fs *FileStore) replay() error {
+	r := bufio.NewReader(fs.file)
+	var offset int64 // where the current line starts
+	line := 0
+	for {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read store file: %w", err)
+		}
+		line++
+		var rec logRecord
+		bad := json.Unmarshal(data, &rec)
+		if bad == nil && err == io.EOF {
+			bad = io.ErrUnexpectedEOF // cut off right before its newline
+		}
+		if bad != nil {
+			if _, err := r.Peek(1); err != io.EOF {
+				return fmt.Errorf("store file line %d: %w", line, bad)
+			}
+			slog.Warn("dropping torn last record of store file", "path", fs.path, "line", line, "err", bad)
+			if err := fs.file.Truncate(offset); err != nil {
+				return fmt.Errorf("truncate store file: %w", err)
+			}
+			line--
+			break
+		}
+		if err := fs.apply(&rec); err != nil {
+			return fmt.Errorf("store file line %d: %w", line, err)
+		}
+		offset += int64(len(data))
+	}
+	fs.records = line
+	return nil
+}
+
+func (fs *FileStore) apply(rec *logRecord) error {
+	switch rec.Op {
+	case "create":
+		return fs.mem.Create(rec.Link)
+	case "update":
+		_, err := fs.mem.Update(rec.Link.Domain, rec.Link.Key, func(l *Link) error {
+			*l = *rec.Link
+			return nil
+		})
+		return err
+	case "hit":
+		fs.mem.addClick(rec.Domain, rec.Key)
+		return nil
+	case "delete":
+		return fs.mem.Delete(rec.Domain, rec.Key)
+	default:
+		return fmt.Errorf("unknown op %q", rec.Op)
+	}
+}
+
+// append writes rec to the log. Only records that must survive a crash are
+// synced; losing the last few click counts is cheaper than an fsync per
+// redirect.
+func (fs *FileStore) append(rec *logRecord, sync bool) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := fs.w.Write(data); err != nil {
+		return err
+	}
+	if err := fs.w.Flush(); err != nil {
+		return err
+	}
+	fs.records++
+	if !sync {
+		return nil
+	}
+	return fs.file.Sync()
+}
+
+// maybeCompact rewrites the log once most of its records are stale. It must
+// be called with fs.mu held and after the last record has been applied, so
+// the snapshot matches the log it replaces.
+func (fs *FileStore) maybeCompact() error {
+	n, _ := fs.mem.Count()
+	if fs.records < compactMinRecords || fs.records <= 2*n {
+		return nil
+	}
+	return fs.compact()
+}
+
+// compact writes a create record for every link, click count included, to a
+// temporary file and renames it over the log. A crash halfway leaves the old
+// log in place.
+func (fs *FileStore) compact() error {
+	tmpPath := fs.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("compact store file: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	records := 0
+	err = fs.mem.Walk(func(link *Link) error {
+		records++
+		return enc.Encode(&logRecord{Op: "create", Link: link})
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, fs.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("compact store file: %w", err)
+	}
+
+	file, err := os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("reopen store file: %w", err)
+	}
+	fs.file.Close()
+	fs.file, fs.w, fs.records = file, bufio.NewWriter(file), records
+	return nil
+}
+
+func (fs *FileStore) Create(link *Link) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.create(link, true)
+}
+
+// create and update must be called with fs.mu held. fs.mu serialises
+// writers, so checking first and logging before the in-memory change never
+// leaves a record in the log that failed to apply.
+func (fs *FileStore) create(link *Link, sync bool) error {
+	if _, err := fs.mem.Get(link.Domain, link.Key); err == nil {
+		return ErrKeyExists
+	}
+	if err := fs.append(&logRecord{Op: "create", Link: link}, sync); err != nil {
+		return err
+	}
+	return fs.mem.Create(link)
+}
+
+func (fs *FileStore) Get(domain, key string) (*Link, error) {
+	return fs.mem.Get(domain, key)
+}
+
+func (fs *FileStore) FindByURL(domain, owner, url string) (*Link, error) {
+	return fs.mem.FindByURL(domain, owner, url)
+}
+
+func (fs *FileStore) Update(domain, key string, fn func(*Link) error) (*Link, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.update(domain, key, fn, true)
+}
+
+func (fs *FileStore) update(domain, key string, fn func(*Link) error, sync bool) (*Link, error) {
+	// Work on a copy so a failed append leaves memory and log in agreement.
+	link, err := fs.mem.Get(domain, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(link); err != nil {
+		return nil, err
+	}
+	link.Domain, link.Key = domain, key
+	if err := fs.append(&logRecord{Op: "update", Link: link}, sync); err != nil {
+		return nil, err
+	}
+	return fs.mem.Update(domain, key, func(l *Link) error {
+		*l = *link
+		return nil
+	})
+}
+
+// fileBatch writes through a FileStore whose lock the batch holds, without
+// syncing each record.
+type fileBatch struct{ fs *FileStore }
+
+func (b fileBatch) Create(link *Link) error { return b.fs.create(link, false) }
+
+func (b fileBatch) Get(domain, key string) (*Link, error) { return b.fs.mem.Get(domain, key) }
+
+func (b fileBatch) Update(domain, key string, fn func(*Link) error) (*Link, error) {
+	return b.fs.update(domain, key, fn, false)
+}
+
+// Batch holds off other writers while fn runs and syncs the log once at the
+// end.
+func (fs *FileStore) Batch(fn func(LinkBatch) error) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	err := fn(fileBatch{fs})
+	if serr := fs.file.Sync(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+func (fs *FileStore) Delete(domain, key string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, err := fs.mem.Get(domain, key); err != nil {
+		return err
+	}
+	if err := fs.append(&logRecord{Op: "delete", Domain: domain, Key: key}, true); err != nil {
+		return err
+	}
+	return fs.mem.Delete(domain, key)
+}
+
+func (fs *FileStore) List(domain, owner, after string, limit int) ([]*Link, error) {
+	return fs.mem.List(domain, owner, after, limit)
+}
+
+func (fs *FileStore) Walk(fn func(*Link) error) error {
+	return fs.mem.Walk(fn)
+}
+
+func (fs *FileStore) Hit(domain, key string, now time.Time) (*Link, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// The click is logged before it is counted, so a failed append does
+	// not leave a count the log does not have.
+	if err := fs.mem.checkHit(domain, key, now); err != nil {
+		return nil, err
+	}
+	if err := fs.append(&logRecord{Op: "hit", Domain: domain, Key: key}, false); err != nil {
+		return nil, err
+	}
+	link, err := fs.mem.Hit(domain, key, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.maybeCompact(); err != nil {
+		// The log is still complete, only longer than it should be.
+		slog.Warn("compacting store file failed", "path", fs.path, "err", err)
+	}
+	return link, nil
+}
+
+func (fs *FileStore) PurgeDead(now time.Time) ([]*Link, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dead := fs.mem.deadLinks(now)
+	for i, link := range dead {
+		if err := fs.append(&logRecord{Op: "delete", Domain: link.Domain, Key: link.Key}, false); err != nil {
+			return dead[:i], err
+		}
+		fs.mem.Delete(link.Domain, link.Key)
+	}
+	if len(dead) == 0 {
+		return nil, nil
+	}
+	return dead, fs.file.Sync()
+}
+
+func (fs *FileStore) Count() (int, error) {
+	return fs.mem.Count()
+}
+
+func (fs *FileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.w.Flush(); err != nil {
+		fs.file.Close()
+		return err
+	}
+	return fs.file.Close()
+}
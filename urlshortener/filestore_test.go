@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const goodRecord = `{"op":"create","link":{"key":"abc","url":"https://example.com/"}}` + "\n"
+
+func TestFileStoreDropsTornLastRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.log")
+	if err := os.WriteFile(path, []byte(goodRecord+`{"op":"hit","dom`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Get("", "abc"); err != nil {
+		t.Errorf("link before the torn record: %v", err)
+	}
+	fs.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != goodRecord {
+		t.Errorf("store file = %q, want the torn record cut off", data)
+	}
+}
+
+func TestFileStoreRefusesCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.log")
+	if err := os.WriteFile(path, []byte("{garbage\n"+goodRecord), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewFileStore(path)
+	if err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("NewFileStore = %v, want an error for line 1", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportMovesCounter(t *testing.T) {
+	store := NewMemoryStore()
+	domains, err := NewDomains("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	us := NewUrlShortener(store, NewCounterGenerator(0), nil, NewRuleBlocklist(), domains, nil, nil, false)
+
+	// The keys the counter would hand out first.
+	var csv strings.Builder
+	csv.WriteString("key,url\n")
+	for n := uint64(1); n <= 50; n++ {
+		fmt.Fprintf(&csv, "%s,https://example.com/%d\n", encodeBase62(n), n)
+	}
+	src, err := NewLinkReader("csv", strings.NewReader(csv.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	res, err := us.Import(src, ConflictFail, "", nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Created != 50 {
+		t.Fatalf("created %d links, want 50", res.Created)
+	}
+
+	link, created, err := us.Shorten(LinkRequest{URL: "https://example.com/new"}, "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || link.Key != encodeBase62(51) {
+		t.Errorf("Shorten gave key %q (created %v), want %q", link.Key, created, encodeBase62(51))
+	}
+}
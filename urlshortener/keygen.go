@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	shortUrlLength = 6
+	charset        = "1234567890abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	// maxKeyAttempts bounds how often ShortenUrl asks the generator for a new
+	// key after the store reported a collision.
+	maxKeyAttempts = 10
+)
+
+// KeyGenerator proposes short keys. Generators only have to make collisions
+// unlikely; uniqueness is enforced by Store.Create, and ShortenUrl retries
+// with attempt+1 when a proposed key is already taken.
+type KeyGenerator interface {
+	Generate(longURL string, attempt int) string
+}
+
+// CounterGenerator hands out a monotonically increasing ID encoded in base62.
+type CounterGenerator struct {
+	next atomic.Uint64
+}
+
+// NewCounterGenerator starts counting at start. Seeding it with the highest
+// key already stored keeps a restarted server from walking over old keys.
+func NewCounterGenerator(start uint64) *CounterGenerator {
+	g := &CounterGenerator{}
+	g.next.Store(start)
+	return g
+}
+
+func (g *CounterGenerator) Generate(longURL string, attempt int) string {
+	return encodeBase62(g.next.Add(1))
+}
+
+// keyObserver is implemented by generators that need to hear of keys stored
+// without them, such as imported ones.
+type keyObserver interface {
+	Observe(key string)
+}
+
+// Observe moves the counter past key when key is one the counter has yet to
+// hand out, so that it is not handed out again.
+func (g *CounterGenerator) Observe(key string) {
+	n, ok := decodeBase62(key)
+	if !ok {
+		return
+	}
+	for {
+		cur := g.next.Load()
+		if n <= cur || g.next.CompareAndSwap(cur, n) {
+			return
+		}
+	}
+}
+
+// RandomGenerator picks shortUrlLength random characters from charset.
+type RandomGenerator struct {
+	rand *rand.Rand
+	mu   sync.Mutex
+}
+
+func NewRandomGenerator() *RandomGenerator {
+	return &RandomGenerator{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (g *RandomGenerator) Generate(longURL string, attempt int) string {
+	// rand.Rand is not safe for concurrent use.
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	shortKey := make([]byte, shortUrlLength)
+	for i := range shortKey {
+		shortKey[i] = charset[g.rand.Intn(len(charset))]
+	}
+	return string(shortKey)
+}
+
+// HashGenerator derives the key from a SHA-256 of the URL. The first attempt
+// for a URL is deterministic; retries mix in a process-wide salt so the same
+// URL can be shortened any number of times.
+type HashGenerator struct {
+	salt atomic.Uint64
+}
+
+func (g *HashGenerator) Generate(longURL string, attempt int) string {
+	input := longURL
+	if attempt > 0 {
+		input += "#" + strconv.FormatUint(g.salt.Add(1), 10)
+	}
+	sum := sha256.Sum256([]byte(input))
+	// Setting the top bit keeps the encoding at full width, so the low
+	// digits are always present.
+	key := encodeBase62(binary.BigEndian.Uint64(sum[:8]) | 1<<63)
+	return key[len(key)-shortUrlLength:]
+}
+
+func encodeBase62(n uint64) string {
+	if n == 0 {
+		return charset[:1]
+	}
+	var buf [11]byte
+	i := len(buf)
+	for n > 0 {
+		i--
+		buf[i] = charset[n%uint64(len(charset))]
+		n /= uint64(len(charset))
+	}
+	return string(buf[i:])
+}
+
+// decodeBase62 reverses encodeBase62. ok is false for keys that are not made
+// of charset or do not fit in a uint64, which no counter ever issued.
+func decodeBase62(key string) (n uint64, ok bool) {
+	if key == "" {
+		return 0, false
+	}
+	base := uint64(len(charset))
+	for i := 0; i < len(key); i++ {
+		d := strings.IndexByte(charset, key[i])
+		if d < 0 || n > (math.MaxUint64-uint64(d))/base {
+			return 0, false
+		}
+		n = n*base + uint64(d)
+	}
+	return n, true
+}
+
+// highestCounterKey returns the largest value any stored key decodes to.
+// Counting the links instead would reissue keys after a delete or purge,
+// since the count then drops below the last key handed out. Aliases and
+// random keys may decode too; that only skips part of the counter range.
+func highestCounterKey(store Store) (uint64, error) {
+	var highest uint64
+	err := store.Walk(func(link *Link) error {
+		if n, ok := decodeBase62(link.Key); ok && n > highest {
+			highest = n
+		}
+		return nil
+	})
+	return highest, err
+}
+
+func newKeyGenerator(kind string, store Store) (KeyGenerator, error) {
+	switch kind {
+	case "random":
+		return NewRandomGenerator(), nil
+	case "counter":
+		highest, err := highestCounterKey(store)
+		if err != nil {
+			return nil, fmt.Errorf("scan stored keys: %w", err)
+		}
+		return NewCounterGenerator(highest), nil
+	case "hash":
+		return &HashGenerator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown key generator %q (want random, counter or hash)", kind)
+	}
+}
@@ -1,29 +1,146 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"math/rand"
+	"io"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
-var seedRand = rand.New(rand.NewSource(time.Now().UnixNano()))
-
-const (
-	shortUrlLength = 6
-	charset = "1234567890abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-)
-
 type UrlShortener struct {
-	shortToLong map[string]string
-	mu sync.RWMutex
+	store     Store
+	keygen    KeyGenerator
+	analytics *Analytics
+	blocklist Blocklist
+	domains   *Domains
+	apiKeys   *APIKeys     // nil leaves link creation and management open
+	titles    TitleFetcher // nil leaves titles off the preview page
+
+	// dedup makes Shorten hand out an owner's existing link for a URL
+	// instead of creating a new one. dedupMu keeps two identical requests
+	// from both missing the lookup and creating two links.
+	dedup   bool
+	dedupMu sync.Mutex
 }
 
-func NewUrlShortener() *UrlShortener {
+func NewUrlShortener(store Store, keygen KeyGenerator, analytics *Analytics, blocklist Blocklist, domains *Domains, apiKeys *APIKeys, titles TitleFetcher, dedup bool) *UrlShortener {
 	return &UrlShortener{
-		shortToLong: make(map[string]string),
+		store:     store,
+		keygen:    keygen,
+		analytics: analytics,
+		blocklist: blocklist,
+		domains:   domains,
+		apiKeys:   apiKeys,
+		titles:    titles,
+		dedup:     dedup,
+	}
+}
+
+// LinkRequest describes a link to create, whether it came in through the
+// /shorten form or the JSON API.
+type LinkRequest struct {
+	URL       string    `json:"url"`
+	Domain    string    `json:"domain,omitempty"`
+	Alias     string    `json:"alias,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	MaxClicks int64     `json:"max_clicks,omitempty"`
+}
+
+var ErrInvalidRequest = errors.New("invalid request")
+
+// Shorten validates req and stores the new link. host is the host the
+// request reached the shortener on; it picks the domain unless req names one.
+// created is false when dedup returned an existing link.
+func (us *UrlShortener) Shorten(req LinkRequest, host string, now time.Time) (link *Link, created bool, err error) {
+	if req.URL == "" {
+		return nil, false, fmt.Errorf("%w: url field is required", ErrInvalidRequest)
+	}
+	domain := us.domains.Resolve(host)
+	if req.Domain != "" {
+		if domain, err = us.domains.Lookup(req.Domain); err != nil {
+			return nil, false, err
+		}
+	}
+	destination, err := us.checkURL(req.URL, host)
+	if err != nil {
+		return nil, false, err
+	}
+	if req.Alias != "" {
+		if err := validateAlias(req.Alias); err != nil {
+			return nil, false, err
+		}
+	}
+	if !req.ExpiresAt.IsZero() && !req.ExpiresAt.After(now) {
+		return nil, false, fmt.Errorf("%w: expires_at must be in the future", ErrInvalidRequest)
+	}
+	if req.MaxClicks < 0 {
+		return nil, false, fmt.Errorf("%w: max_clicks must be a positive integer", ErrInvalidRequest)
+	}
+
+	link = &Link{
+		Domain:    domain,
+		Key:       req.Alias,
+		URL:       destination,
+		Owner:     req.Owner,
+		CreatedAt: now.UTC(),
+		MaxClicks: req.MaxClicks,
+	}
+	if !req.ExpiresAt.IsZero() {
+		link.ExpiresAt = req.ExpiresAt.UTC()
+	}
+
+	// An explicit alias always gets its own link.
+	if us.dedup && req.Alias == "" && link.Reusable() {
+		us.dedupMu.Lock()
+		defer us.dedupMu.Unlock()
+
+		existing, err := us.store.FindByURL(link.Domain, link.Owner, link.URL)
+		if err == nil {
+			return existing, false, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, false, err
+		}
+	}
+
+	if err := us.createLink(link); err != nil {
+		return nil, false, err
+	}
+	return link, true, nil
+}
+
+// errorStatus maps errors returned by Shorten and the store to HTTP statuses.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidRequest), errors.Is(err, ErrInvalidAlias):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrURLBlocked), errors.Is(err, ErrLinkDisabled), errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrKeyExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrLinkGone):
+		return http.StatusGone
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
 	}
 }
 
@@ -33,53 +150,294 @@ func (us *UrlShortener) ShortenUrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	originalUrl := r.FormValue("url")
-	if originalUrl == "" {
-		http.Error(w, "url field is required", http.StatusBadRequest)
-		return
+	req := LinkRequest{
+		URL:   r.FormValue("url"),
+		Alias: r.FormValue("alias"),
+		Owner: r.FormValue("owner"),
 	}
 
-	shortKey := generateShortKey()
+	if v := r.FormValue("expires_at"); v != "" {
+		expiresAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "expires_at must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		req.ExpiresAt = expiresAt
+	}
+
+	if v := r.FormValue("max_clicks"); v != "" {
+		maxClicks, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxClicks < 1 {
+			http.Error(w, "max_clicks must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		req.MaxClicks = maxClicks
+	}
 
-	us.mu.Lock()
-	us.shortToLong[shortKey] = originalUrl
-	us.mu.Unlock()
+	link, _, err := us.shortenClaimed(r, req)
+	if err != nil {
+		status := errorStatus(err)
+		switch status {
+		case http.StatusBadRequest, http.StatusForbidden, http.StatusTooManyRequests:
+			http.Error(w, err.Error(), status)
+		case http.StatusConflict:
+			http.Error(w, "alias is already taken", status)
+		default:
+			slog.ErrorContext(r.Context(), "storing short url failed", "err", err)
+			http.Error(w, "could not store short url", http.StatusInternalServerError)
+		}
+		return
+	}
 
-	shortUrl := fmt.Sprintf("http://%s/short/%s", r.Host, shortKey)
 	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(shortUrl))
+	w.Write([]byte(us.domains.ShortURL(r, link.Domain, link.Key)))
 	// fmt.Fprintf(w, shortUrl)
 }
 
+// requestDomain is the domain a request addresses: the ?domain= parameter
+// when given, otherwise the host it came in on.
+func (us *UrlShortener) requestDomain(r *http.Request) (string, error) {
+	if name := r.URL.Query().Get("domain"); name != "" {
+		return us.domains.Lookup(name)
+	}
+	return us.domains.Resolve(r.Host), nil
+}
+
 func (us *UrlShortener) HandleRedirect(w http.ResponseWriter, r *http.Request) {
 	key := strings.TrimPrefix(r.URL.Path, "/short/")
-	us.mu.RLock()
-	originalUrl, exists := us.shortToLong[key]
-	us.mu.RUnlock()
-
-	if !exists {
-		http.NotFound(w,r)
+	domain := us.domains.Resolve(r.Host)
+	if key, ok := strings.CutSuffix(key, previewSuffix); ok {
+		us.servePreview(w, r, domain, key)
+		return
+	}
+	now := time.Now()
+	link, err := us.store.Hit(domain, key, now)
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, ErrLinkGone) {
+		http.Error(w, "short link has expired", http.StatusGone)
 		return
 	}
+	if errors.Is(err, ErrLinkDisabled) {
+		http.Error(w, "short link has been disabled", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "loading short url failed", "domain", domain, "key", key, "err", err)
+		http.Error(w, "could not load short url", http.StatusInternalServerError)
+		return
+	}
+
+	us.analytics.Record(newClickEvent(link, r, now))
+	http.Redirect(w, r, link.URL, http.StatusFound)
+}
+
+// createLink stores link under its alias, or assigns a fresh key when no
+// alias was requested. Store.Create is the only place a key is claimed, so
+// concurrent callers can never end up sharing one; a taken generated key just
+// costs another attempt, a taken alias is reported as ErrKeyExists.
+func (us *UrlShortener) createLink(link *Link) error {
+	if link.Key != "" {
+		return us.store.Create(link)
+	}
+	for attempt := 0; attempt < maxKeyAttempts; attempt++ {
+		link.Key = us.keygen.Generate(link.URL, attempt)
+		err := us.store.Create(link)
+		if !errors.Is(err, ErrKeyExists) {
+			return err
+		}
+	}
+	return fmt.Errorf("no free short key after %d attempts", maxKeyAttempts)
+}
 
-	http.Redirect(w,r,originalUrl,http.StatusFound)
+// RunSweeper purges expired and used up links from the store every interval
+// until ctx is cancelled.
+func (us *UrlShortener) RunSweeper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// A key purged and taken again must not inherit the
+				// old link's stats, even when purging failed halfway.
+				purged, err := us.store.PurgeDead(time.Now())
+				for _, link := range purged {
+					us.analytics.Forget(link.Domain, link.Key)
+				}
+				if err != nil {
+					log.Printf("Error purging dead links: %v", err)
+					continue
+				}
+				if len(purged) > 0 {
+					log.Printf("Purged %d dead links", len(purged))
+				}
+			}
+		}
+	}()
 }
 
-func generateShortKey() string {
-	
-	shortKey := make([]byte, shortUrlLength)
-	for i := range shortKey {
-		shortKey[i] = charset[seedRand.Intn(len(charset))]
+func openStore(kind, path, driver string) (Store, error) {
+	switch kind {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		return NewFileStore(path)
+	case "sql":
+		return NewSQLStore(driver, path)
+	default:
+		return nil, fmt.Errorf("unknown store %q (want memory, file or sql)", kind)
 	}
-	return string(shortKey)
 }
 
 func main() {
-	shortener := NewUrlShortener()
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
+	addr := flag.String("addr", ":8080", "address to listen on")
+	readTimeout := flag.Duration("read-timeout", 10*time.Second, "maximum time to read a request including its body")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 5*time.Second, "maximum time to read request headers")
+	writeTimeout := flag.Duration("write-timeout", 30*time.Second, "maximum time to write a response")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "how long idle keep-alive connections are kept open")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long in-flight requests may take to finish on shutdown")
+	logFormat := flag.String("log-format", "text", "log output: text or json")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	storeConfig := addStoreFlags(flag.CommandLine)
+	checkConfig := addCheckFlags(flag.CommandLine)
+	keygenKind := flag.String("keygen", "random", "short key generator: random, counter or hash")
+	sweepInterval := flag.Duration("sweep-interval", time.Minute, "how often expired links are purged")
+	clickLogPath := flag.String("click-log", "", "append click events as JSON lines to this file")
+	cacheSize := flag.Int("cache-size", 10000, "links kept in the redirect cache (0 disables it)")
+	cacheTTL := flag.Duration("cache-ttl", 5*time.Minute, "how long a cached link is served")
+	cacheNegativeTTL := flag.Duration("cache-negative-ttl", 30*time.Second, "how long an unknown key is remembered")
+	dedup := flag.Bool("dedup", false, "return the existing short link when an owner shortens the same URL again")
+	adminToken := flag.String("admin-token", "", "bearer token for the /admin endpoints (disabled when empty)")
+	apiKeysPath := flag.String("api-keys", "", "file with \"key owner [quota]\" lines; when set, creating and managing links needs a key")
+	keyQuota := flag.Int("key-quota", 100, "links an API key may create per -key-quota-interval unless its line says otherwise")
+	fetchTitles := flag.Bool("fetch-titles", false, "show the destination page title on link previews (fetches the destination)")
+	keyQuotaInterval := flag.Duration("key-quota-interval", time.Hour, "window of the per-key creation quota")
+	flag.Parse()
+	if err := applyEnv(flag.CommandLine); err != nil {
+		log.Fatal("Error reading environment: ", err)
+	}
+	if err := setupLogging(*logFormat, *logLevel); err != nil {
+		log.Fatal("Error configuring logging: ", err)
+	}
+
+	store, err := storeConfig.open()
+	if err != nil {
+		log.Fatal("Error opening store: ", err)
+	}
+	var cachingStore *CachingStore
+	if *cacheSize > 0 {
+		cachingStore = NewCachingStore(store, *cacheSize, *cacheTTL, *cacheNegativeTTL)
+		store = cachingStore
+	}
+	defer store.Close()
+
+	keygen, err := newKeyGenerator(*keygenKind, store)
+	if err != nil {
+		log.Fatal("Error creating key generator: ", err)
+	}
+
+	// ctx stops the background workers. It is cancelled only after the
+	// server has drained, so the last requests still get their clicks counted.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var clickLog io.ReadWriter
+	if *clickLogPath != "" {
+		f, err := os.OpenFile(*clickLogPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal("Error opening click log: ", err)
+		}
+		defer f.Close()
+		clickLog = f
+	}
+	analytics := NewAnalytics(4096, clickLog)
+	if clickLog != nil {
+		if err := analytics.Replay(clickLog, liveClicks(store)); err != nil {
+			log.Fatal("Error reading click log: ", err)
+		}
+	}
+	analytics.Run(ctx)
+
+	blocklist, domains, err := checkConfig.load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var apiKeys *APIKeys
+	if *apiKeysPath != "" {
+		if *keyQuota < 1 || *keyQuotaInterval <= 0 {
+			log.Fatal("-key-quota and -key-quota-interval must be positive")
+		}
+		if apiKeys, err = LoadAPIKeys(*apiKeysPath, *keyQuota, *keyQuotaInterval); err != nil {
+			log.Fatal("Error loading API keys: ", err)
+		}
+	}
+
+	var titles TitleFetcher
+	if *fetchTitles {
+		titles = NewCachingTitleFetcher(NewHTTPTitleFetcher(3*time.Second), time.Hour)
+	}
+
+	shortener := NewUrlShortener(store, keygen, analytics, blocklist, domains, apiKeys, titles, *dedup)
+	shortener.RunSweeper(ctx, *sweepInterval)
 
-	http.HandleFunc("/shorten", shortener.ShortenUrl)
+	http.HandleFunc("/shorten", shortener.requireAPIKey(shortener.ShortenUrl))
 	http.HandleFunc("/short/", shortener.HandleRedirect)
+	http.HandleFunc("GET /short/{key}/qr", shortener.HandleQR)
+	http.HandleFunc("GET /stats/{key}", shortener.HandleStats)
+	shortener.registerAPI(http.DefaultServeMux)
+	if cachingStore != nil {
+		http.HandleFunc("GET /debug/cache", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, cachingStore.Stats())
+		})
+	}
+	if *adminToken != "" {
+		shortener.registerAdmin(http.DefaultServeMux, *adminToken)
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal("Error listening: ", err)
+	}
+	srv := &http.Server{
+		Handler:           logRequests(http.DefaultServeMux),
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(ln) }()
+	slog.Info("server started", "addr", ln.Addr().String(), "store", *storeConfig.kind)
+
+	select {
+	case err := <-serveErr:
+		slog.Error("server stopped", "err", err)
+	case <-sigCtx.Done():
+		stop()
+		slog.Info("shutting down", "timeout", *shutdownTimeout)
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancelShutdown()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("shutdown did not finish in time", "err", err)
+		}
+	}
 
-	fmt.Println("Server started on localhost 8080")
-	http.ListenAndServe(":8080", nil)
+	cancel()
+	analytics.Wait()
+	slog.Info("server stopped")
 }
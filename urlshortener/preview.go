@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// previewSuffix appended to a short link shows the preview page instead of
+// redirecting, as in /short/abc123+.
+const previewSuffix = "+"
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Preview of {{.ShortURL}}</title>
+</head>
+<body>
+<h1>{{.ShortURL}}</h1>
+{{if .Title}}<p><strong>{{.Title}}</strong></p>{{end}}
+<p>This short link points to:</p>
+<p><code>{{.Link.URL}}</code></p>
+<dl>
+<dt>Created</dt><dd>{{.Link.CreatedAt.Format "2 January 2006 15:04 MST"}}</dd>
+<dt>Clicks</dt><dd>{{.Link.Clicks}}</dd>
+{{if not .Link.ExpiresAt.IsZero}}<dt>Expires</dt><dd>{{.Link.ExpiresAt.Format "2 January 2006 15:04 MST"}}</dd>{{end}}
+</dl>
+{{if .Status}}<p>{{.Status}}</p>{{else}}<p><a href="{{.Link.URL}}" rel="noopener noreferrer nofollow">Continue to the destination</a></p>{{end}}
+</body>
+</html>
+`))
+
+type previewPage struct {
+	Link     *Link
+	ShortURL string
+	Title    string
+	Status   string // why the link no longer redirects, if it doesn't
+}
+
+// servePreview shows where a short link goes without following it or
+// counting a click.
+func (us *UrlShortener) servePreview(w http.ResponseWriter, r *http.Request, domain, key string) {
+	link, err := us.store.Get(domain, key)
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "loading short url failed", "domain", domain, "key", key, "err", err)
+		http.Error(w, "could not load short url", http.StatusInternalServerError)
+		return
+	}
+
+	page := previewPage{Link: link, ShortURL: us.domains.ShortURL(r, domain, key)}
+	switch {
+	case link.Disabled:
+		page.Status = "This short link has been disabled."
+	case link.Dead(time.Now()):
+		page.Status = "This short link has expired."
+	}
+	if us.titles != nil && page.Status == "" {
+		title, err := us.titles.Title(r.Context(), link.URL)
+		if err != nil {
+			slog.DebugContext(r.Context(), "fetching destination title failed", "url", link.URL, "err", err)
+		}
+		page.Title = title
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := previewTemplate.Execute(w, page); err != nil {
+		slog.ErrorContext(r.Context(), "rendering preview failed", "err", err)
+	}
+}
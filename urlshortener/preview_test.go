@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stubTitles map[string]string
+
+func (s stubTitles) Title(ctx context.Context, url string) (string, error) {
+	return s[url], nil
+}
+
+func TestPreview(t *testing.T) {
+	store := NewMemoryStore()
+	created := time.Date(2024, time.March, 5, 14, 30, 0, 0, time.UTC)
+	err := store.Create(&Link{Key: "abc123", URL: "https://example.com/article", CreatedAt: created, Clicks: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains, err := NewDomains("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := stubTitles{"https://example.com/article": "An Example Article"}
+	us := NewUrlShortener(store, nil, nil, nil, domains, nil, titles, false)
+
+	srv := httptest.NewServer(http.HandlerFunc(us.HandleRedirect))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/short/abc123" + previewSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	page := string(body)
+	for _, want := range []string{
+		"https://example.com/article",
+		"5 March 2024 14:30 UTC",
+		"<dd>7</dd>",
+		"An Example Article",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("preview page does not contain %q:\n%s", want, page)
+		}
+	}
+
+	link, err := store.Get("", "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Clicks != 7 {
+		t.Errorf("clicks = %d after preview, want 7", link.Clicks)
+	}
+}
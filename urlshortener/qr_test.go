@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestQRFormatBits(t *testing.T) {
+	// From the format information table of ISO/IEC 18004.
+	for _, tc := range []struct {
+		level QRLevel
+		mask  int
+		want  int
+	}{
+		{QRLevelL, 0, 0b111011111000100},
+		{QRLevelL, 4, 0b110011000101111},
+		{QRLevelM, 0, 0b101010000010010},
+		{QRLevelM, 5, 0b100000011001110},
+		{QRLevelQ, 7, 0b010101111101101},
+		{QRLevelH, 0, 0b001011010001001},
+		{QRLevelH, 6, 0b000110100001100},
+	} {
+		if got := qrFormatBits(tc.level, tc.mask); got != tc.want {
+			t.Errorf("qrFormatBits(%d, %d) = %015b, want %015b", tc.level, tc.mask, got, tc.want)
+		}
+	}
+}
+
+func TestRSRemainder(t *testing.T) {
+	// "HELLO WORLD" as a 1-M symbol, the usual worked example.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsGenerator(len(want))); !bytes.Equal(got, want) {
+		t.Errorf("ECC codewords = %v, want %v", got, want)
+	}
+}
+
+// The golden symbols were made by github.com/skip2/go-qrcode, an encoder
+// written independently of this one, without its quiet zone.
+
+func TestEncodeQRSmall(t *testing.T) {
+	want := []string{
+		"#######..##.#.##..#######",
+		"#.....#.#.#....#..#.....#",
+		"#.###.#...#.#..##.#.###.#",
+		"#.###.#..###.#.#..#.###.#",
+		"#.###.#.########..#.###.#",
+		"#.....#...#...###.#.....#",
+		"#######.#.#.#.#.#.#######",
+		"...........#...#.........",
+		"#.#.#.#...##....#...#..#.",
+		"##..#....###.#..###.....#",
+		".#######......#....#..###",
+		"##.#.....#.####.##.#...#.",
+		"#.#.###.#.#...######.#.##",
+		".#.#...#.#.#..#..##..#..#",
+		"#.#.#######..#..##.#..###",
+		".#..##.#...#...##.#.#..#.",
+		"#...#.##..#.#...######...",
+		"........#..###..#...##.##",
+		"#######...###.###.#.##.##",
+		"#.....#..##.###.#...##.##",
+		"#.###.#.#.##..#.######..#",
+		"#.###.#..#.#..####.####..",
+		"#.###.#.##...#..#...#...#",
+		"#.....#..###....#.#.##.#.",
+		"#######.#.#.#..##..#...##",
+	}
+	got := renderQR(t, "https://sho.rt/abc", QRLevelM)
+	for y := range want {
+		if y >= len(got) || got[y] != want[y] {
+			t.Fatalf("symbol differs from row %d:\n%s\nwant:\n%s", y, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestEncodeQRLarge(t *testing.T) {
+	// Version 12 at level H: several blocks of two sizes, alignment patterns
+	// and version information.
+	const url = "https://example.com/some/rather/long/path/that/needs/a/bigger/symbol/with/several/blocks/and/version/bits?query=yes&more=please&again=sure"
+	const want = "caf6231bf071f57042d23fde683209036a83e281a5360a32824fff3d3126cb9e"
+	rows := renderQR(t, url, QRLevelH)
+	if len(rows) != 65 {
+		t.Fatalf("size = %d, want 65", len(rows))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(rows, "\n")))
+	if got := hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("symbol hash = %s, want %s", got, want)
+	}
+}
+
+func renderQR(t *testing.T, data string, level QRLevel) []string {
+	t.Helper()
+	q, err := EncodeQR([]byte(data), level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := make([]string, q.Size)
+	for y := range rows {
+		var b strings.Builder
+		for x := 0; x < q.Size; x++ {
+			if q.Dark(x, y) {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		rows[y] = b.String()
+	}
+	return rows
+}
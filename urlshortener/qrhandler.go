@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+const (
+	qrQuietZone     = 4 // modules of light border required around the symbol
+	defaultQRSize   = 256
+	maxQRSize       = 2048
+	defaultQRFormat = "png"
+	defaultQRLevel  = "M"
+)
+
+// HandleQR serves GET /short/{key}/qr. Query parameters: format (png or svg),
+// size (approximate width in pixels) and ec (L, M, Q or H).
+func (us *UrlShortener) HandleQR(w http.ResponseWriter, r *http.Request) {
+	domain, err := us.requestDomain(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := r.PathValue("key")
+	_, err = us.store.Get(domain, key)
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "loading short url failed", "domain", domain, "key", key, "err", err)
+		http.Error(w, "could not load short url", http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = defaultQRFormat
+	}
+	if format != "png" && format != "svg" {
+		http.Error(w, "format must be png or svg", http.StatusBadRequest)
+		return
+	}
+
+	size := defaultQRSize
+	if v := q.Get("size"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size < 1 || size > maxQRSize {
+			http.Error(w, fmt.Sprintf("size must be between 1 and %d", maxQRSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	levelID := q.Get("ec")
+	if levelID == "" {
+		levelID = defaultQRLevel
+	}
+	level, err := ParseQRLevel(levelID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	code, err := EncodeQR([]byte(us.domains.ShortURL(r, domain, key)), level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		writeQRSVG(w, code, size)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, qrImage(code, size)); err != nil {
+		slog.ErrorContext(r.Context(), "encoding qr png failed", "err", err)
+		http.Error(w, "could not render qr code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// qrImage renders code with a whole number of pixels per module, as close to
+// size pixels wide as that allows.
+func qrImage(code *QRCode, size int) image.Image {
+	modules := code.Size + 2*qrQuietZone
+	scale := max(1, size/modules)
+	px := modules * scale
+
+	img := image.NewPaletted(image.Rect(0, 0, px, px), color.Palette{color.White, color.Black})
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if !code.Dark(x, y) {
+				continue
+			}
+			x0, y0 := (x+qrQuietZone)*scale, (y+qrQuietZone)*scale
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(x0+dx, y0+dy, 1)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// writeQRSVG draws one path in module units and lets the viewBox scale it.
+func writeQRSVG(w io.Writer, code *QRCode, size int) {
+	modules := code.Size + 2*qrQuietZone
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, modules, modules)
+	fmt.Fprintf(w, `<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="`)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Dark(x, y) {
+				fmt.Fprintf(w, "M%d %dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+	fmt.Fprint(w, `"/></svg>`)
+}
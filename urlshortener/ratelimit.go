@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket is the token bucket from ratelimiter/tokenbucket.go, refilled
+// lazily in Allow instead of by a ticker goroutine, since the shortener keeps
+// one bucket per API key.
+type TokenBucket struct {
+	capacity   int
+	tokens     int
+	refillRate time.Duration // one token is added every refillRate
+	lastRefill time.Time
+	mu         sync.Mutex
+}
+
+func NewTokenBucket(capacity int, refillRate time.Duration) *TokenBucket {
+	return &TokenBucket{
+		capacity:   capacity,
+		tokens:     capacity,
+		refillRate: refillRate,
+		lastRefill: time.Now(),
+	}
+}
+
+func (t *TokenBucket) Allow() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(t.lastRefill); elapsed >= t.refillRate {
+		n := int(elapsed / t.refillRate)
+		t.tokens = min(t.capacity, t.tokens+n)
+		t.lastRefill = t.lastRefill.Add(time.Duration(n) * t.refillRate)
+	}
+	// A full bucket does not bank refills.
+	if t.tokens == t.capacity {
+		t.lastRefill = now
+	}
+	if t.tokens > 0 {
+		t.tokens--
+		return true
+	}
+	return false
+}
+
+// Return gives back a token taken by Allow for work that did not happen.
+func (t *TokenBucket) Return() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens = min(t.capacity, t.tokens+1)
+}
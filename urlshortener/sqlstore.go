@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// Timestamps are stored as Unix nanoseconds; an expires_at of 0 means the
+// link never expires and a max_clicks of 0 means it is not limited.
+var sqlSchema = []string{`CREATE TABLE IF NOT EXISTS links (
+	domain     TEXT NOT NULL DEFAULT '',
+	short_key  TEXT NOT NULL,
+	url        TEXT NOT NULL,
+	owner      TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL DEFAULT 0,
+	max_clicks INTEGER NOT NULL DEFAULT 0,
+	clicks     INTEGER NOT NULL DEFAULT 0,
+	disabled   INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (domain, short_key)
+)`,
+	`CREATE INDEX IF NOT EXISTS links_owner ON links (domain, owner, short_key)`,
+	`CREATE INDEX IF NOT EXISTS links_owner_url ON links (domain, owner, url)`,
+}
+
+const linkColumns = `domain, short_key, url, owner, created_at, expires_at, max_clicks, clicks, disabled`
+
+// SQLStore stores links in a SQL database through database/sql. The queries
+// stick to plain SQL with ? placeholders so they run on SQLite. The pure Go
+// modernc.org/sqlite driver is linked in as "sqlite"; other drivers have to
+// be linked into the binary by the caller.
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(driver, dsn string) (*SQLStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open %s database: %w", driver, err)
+	}
+	for _, stmt := range sqlSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("create schema: %w", err)
+		}
+	}
+	return &SQLStore{db: db}, nil
+}
+
+func (s *SQLStore) Create(link *Link) error {
+	_, err := s.db.Exec(
+		`INSERT INTO links (`+linkColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		link.Domain, link.Key, link.URL, link.Owner, link.CreatedAt.UnixNano(), unixNanoOrZero(link.ExpiresAt), link.MaxClicks, link.Clicks, link.Disabled,
+	)
+	if err != nil && isUniqueViolation(err) {
+		return ErrKeyExists
+	}
+	return err
+}
+
+func (s *SQLStore) Get(domain, key string) (*Link, error) {
+	row := s.db.QueryRow(`SELECT `+linkColumns+` FROM links WHERE domain = ? AND short_key = ?`, domain, key)
+	link, err := scanLink(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return link, err
+}
+
+func (s *SQLStore) FindByURL(domain, owner, url string) (*Link, error) {
+	row := s.db.QueryRow(
+		`SELECT `+linkColumns+` FROM links
+		WHERE domain = ? AND owner = ? AND url = ? AND expires_at = 0 AND max_clicks = 0 AND disabled = 0
+		ORDER BY created_at LIMIT 1`,
+		domain, owner, url,
+	)
+	link, err := scanLink(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return link, err
+}
+
+func (s *SQLStore) Update(domain, key string, fn func(*Link) error) (*Link, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	link, err := updateLink(tx, domain, key, fn)
+	if err != nil {
+		return nil, err
+	}
+	return link, tx.Commit()
+}
+
+func updateLink(tx *sql.Tx, domain, key string, fn func(*Link) error) (*Link, error) {
+	row := tx.QueryRow(`SELECT `+linkColumns+` FROM links WHERE domain = ? AND short_key = ?`, domain, key)
+	link, err := scanLink(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(link); err != nil {
+		return nil, err
+	}
+	link.Domain, link.Key = domain, key
+
+	// clicks is left alone so concurrent redirects are not lost.
+	_, err = tx.Exec(
+		`UPDATE links SET url = ?, owner = ?, created_at = ?, expires_at = ?, max_clicks = ?, disabled = ?
+		WHERE domain = ? AND short_key = ?`,
+		link.URL, link.Owner, link.CreatedAt.UnixNano(), unixNanoOrZero(link.ExpiresAt), link.MaxClicks, link.Disabled, domain, key,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// sqlBatch writes through one transaction. Create uses ON CONFLICT instead
+// of failing on the primary key, since some databases abort the whole
+// transaction on a failed statement.
+type sqlBatch struct{ tx *sql.Tx }
+
+func (b sqlBatch) Create(link *Link) error {
+	res, err := b.tx.Exec(
+		`INSERT INTO links (`+linkColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (domain, short_key) DO NOTHING`,
+		link.Domain, link.Key, link.URL, link.Owner, link.CreatedAt.UnixNano(), unixNanoOrZero(link.ExpiresAt), link.MaxClicks, link.Clicks, link.Disabled,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrKeyExists
+	}
+	return nil
+}
+
+func (b sqlBatch) Get(domain, key string) (*Link, error) {
+	row := b.tx.QueryRow(`SELECT `+linkColumns+` FROM links WHERE domain = ? AND short_key = ?`, domain, key)
+	link, err := scanLink(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return link, err
+}
+
+func (b sqlBatch) Update(domain, key string, fn func(*Link) error) (*Link, error) {
+	return updateLink(b.tx, domain, key, fn)
+}
+
+// Batch runs fn in one transaction and commits it whatever fn returns.
+func (s *SQLStore) Batch(fn func(LinkBatch) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(sqlBatch{tx})
+	if cerr := tx.Commit(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *SQLStore) Delete(domain, key string) error {
+	res, err := s.db.Exec(`DELETE FROM links WHERE domain = ? AND short_key = ?`, domain, key)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) List(domain, owner, after string, limit int) ([]*Link, error) {
+	query := `SELECT ` + linkColumns + ` FROM links WHERE domain = ? AND short_key > ?`
+	args := []any{domain, after}
+	if owner != "" {
+		query += ` AND owner = ?`
+		args = append(args, owner)
+	}
+	query += ` ORDER BY short_key LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make([]*Link, 0)
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func (s *SQLStore) Walk(fn func(*Link) error) error {
+	rows, err := s.db.Query(`SELECT ` + linkColumns + ` FROM links ORDER BY domain, short_key`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLStore) Hit(domain, key string, now time.Time) (*Link, error) {
+	// The conditions in the WHERE clause make the limit check and the
+	// increment a single atomic statement.
+	res, err := s.db.Exec(
+		`UPDATE links SET clicks = clicks + 1
+		WHERE domain = ? AND short_key = ?
+			AND disabled = 0
+			AND (expires_at = 0 OR expires_at > ?)
+			AND (max_clicks = 0 OR clicks < max_clicks)`,
+		domain, key, now.UnixNano(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := s.Get(domain, key)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		if link.Disabled {
+			return nil, ErrLinkDisabled
+		}
+		return nil, ErrLinkGone
+	}
+	return link, nil
+}
+
+func (s *SQLStore) PurgeDead(now time.Time) ([]*Link, error) {
+	rows, err := s.db.Query(
+		`DELETE FROM links
+		WHERE (expires_at != 0 AND expires_at <= ?)
+			OR (max_clicks != 0 AND clicks >= max_clicks)
+		RETURNING `+linkColumns,
+		now.UnixNano(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var purged []*Link
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return purged, err
+		}
+		purged = append(purged, link)
+	}
+	return purged, rows.Err()
+}
+
+func (s *SQLStore) Count() (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&n)
+	return n, err
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+func scanLink(row interface{ Scan(...any) error }) (*Link, error) {
+	var (
+		link                 Link
+		createdAt, expiresAt int64
+	)
+	err := row.Scan(&link.Domain, &link.Key, &link.URL, &link.Owner, &createdAt, &expiresAt, &link.MaxClicks, &link.Clicks, &link.Disabled)
+	if err != nil {
+		return nil, err
+	}
+	link.CreatedAt = time.Unix(0, createdAt).UTC()
+	if expiresAt != 0 {
+		link.ExpiresAt = time.Unix(0, expiresAt).UTC()
+	}
+	return &link, nil
+}
+
+func unixNanoOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// database/sql has no portable constraint error, so match on the message the
+// common drivers use.
+func isUniqueViolation(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unique") || strings.Contains(msg, "duplicate")
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound     = errors.New("short key not found")
+	ErrKeyExists    = errors.New("short key already exists")
+	ErrLinkGone     = errors.New("short link expired or used up")
+	ErrLinkDisabled = errors.New("short link has been disabled")
+)
+
+type Link struct {
+	Domain    string    `json:"domain,omitempty"` // "" is the default domain
+	Key       string    `json:"key"`
+	URL       string    `json:"url"`
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`  // zero means never
+	MaxClicks int64     `json:"max_clicks,omitempty"` // 0 means unlimited
+	Clicks    int64     `json:"clicks"`
+	Disabled  bool      `json:"disabled,omitempty"` // set by an admin for abusive links
+}
+
+// linkID identifies a link across domains. Keys never contain '/'.
+func linkID(domain, key string) string {
+	return domain + "/" + key
+}
+
+func (l *Link) ID() string {
+	return linkID(l.Domain, l.Key)
+}
+
+func (l *Link) Expired(now time.Time) bool {
+	return !l.ExpiresAt.IsZero() && !now.Before(l.ExpiresAt)
+}
+
+func (l *Link) Exhausted() bool {
+	return l.MaxClicks > 0 && l.Clicks >= l.MaxClicks
+}
+
+// Dead links can never be followed again and are purged by the sweeper.
+func (l *Link) Dead(now time.Time) bool {
+	return l.Expired(now) || l.Exhausted()
+}
+
+// Reusable links can be handed out again for the same owner and URL. Limited
+// and disabled links never are, since reusing them would change what the
+// caller gets.
+func (l *Link) Reusable() bool {
+	return l.ExpiresAt.IsZero() && l.MaxClicks == 0 && !l.Disabled
+}
+
+// Store persists short links. Links are addressed by domain and key, so the
+// same key can exist once per domain. Create must fail with ErrKeyExists
+// instead of overwriting an existing key, Get returns ErrNotFound for unknown
+// keys.
+//
+// Hit counts a redirect through key and returns the updated link. It fails
+// with ErrLinkDisabled or ErrLinkGone, without counting, when the link was
+// disabled, is expired or has no clicks left; the check and the increment are
+// atomic so a limited link is never followed more than MaxClicks times.
+//
+// Update applies fn to a copy of the stored link and saves the result; the
+// key and click count are owned by the store and cannot be changed through it.
+// List returns up to limit links of a domain ordered by key, starting after
+// the key after, optionally restricted to one owner. FindByURL returns a
+// reusable link the owner already has for url on domain, or ErrNotFound.
+//
+// Walk calls fn with a copy of every link, ordered by domain and key, and
+// stops at the first error fn returns. It does not hold up writers while fn
+// runs; links created or deleted during a walk may or may not be seen.
+//
+// PurgeDead deletes every dead link and returns the links it deleted, so
+// their stats can go too.
+type Store interface {
+	Create(link *Link) error
+	Get(domain, key string) (*Link, error)
+	FindByURL(domain, owner, url string) (*Link, error)
+	Update(domain, key string, fn func(*Link) error) (*Link, error)
+	Delete(domain, key string) error
+	List(domain, owner, after string, limit int) ([]*Link, error)
+	Walk(fn func(*Link) error) error
+	Hit(domain, key string, now time.Time) (*Link, error)
+	PurgeDead(now time.Time) ([]*Link, error)
+	Count() (int, error)
+	Close() error
+}
+
+// LinkBatch is the part of a Store an import writes through.
+type LinkBatch interface {
+	Create(link *Link) error
+	Get(domain, key string) (*Link, error)
+	Update(domain, key string, fn func(*Link) error) (*Link, error)
+}
+
+// Batcher is implemented by stores that can group writes, so a bulk import
+// pays one fsync or commit per batch instead of one per link. Batch calls fn
+// with a LinkBatch and makes the writes fn made durable together. It is not
+// a transaction: the writes made before fn returns an error are kept, and
+// fn's error is returned.
+type Batcher interface {
+	Batch(fn func(LinkBatch) error) error
+}
+
+// batchWrites runs fn in a batch when store supports it and directly
+// against store otherwise.
+func batchWrites(store Store, fn func(LinkBatch) error) error {
+	if b, ok := store.(Batcher); ok {
+		return b.Batch(fn)
+	}
+	return fn(store)
+}
+
+// MemoryStore keeps links in shortToLong, keyed by linkID, and maintains
+// longToShort, a reverse index from domain, owner and URL to the ID of a
+// reusable link, alongside it.
+type MemoryStore struct {
+	shortToLong map[string]*Link
+	longToShort map[string]string
+	mu          sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		shortToLong: make(map[string]*Link),
+		longToShort: make(map[string]string),
+	}
+}
+
+func reverseKey(domain, owner, url string) string {
+	return domain + "\x00" + owner + "\x00" + url
+}
+
+// index and unindex must be called with m.mu held. The first reusable link
+// for an owner and URL wins; unindex only drops the entry if it points at
+// link, so other links keep their slot.
+func (m *MemoryStore) index(link *Link) {
+	if !link.Reusable() {
+		return
+	}
+	rk := reverseKey(link.Domain, link.Owner, link.URL)
+	if _, exists := m.longToShort[rk]; !exists {
+		m.longToShort[rk] = link.ID()
+	}
+}
+
+func (m *MemoryStore) unindex(link *Link) {
+	rk := reverseKey(link.Domain, link.Owner, link.URL)
+	if m.longToShort[rk] == link.ID() {
+		delete(m.longToShort, rk)
+	}
+}
+
+func (m *MemoryStore) Create(link *Link) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.shortToLong[link.ID()]; exists {
+		return ErrKeyExists
+	}
+	l := *link
+	m.shortToLong[link.ID()] = &l
+	m.index(&l)
+	return nil
+}
+
+func (m *MemoryStore) Get(domain, key string) (*Link, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	link, exists := m.shortToLong[linkID(domain, key)]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	l := *link
+	return &l, nil
+}
+
+func (m *MemoryStore) FindByURL(domain, owner, url string) (*Link, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, exists := m.longToShort[reverseKey(domain, owner, url)]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	l := *m.shortToLong[id]
+	return &l, nil
+}
+
+func (m *MemoryStore) Update(domain, key string, fn func(*Link) error) (*Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, exists := m.shortToLong[linkID(domain, key)]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	l := *link
+	if err := fn(&l); err != nil {
+		return nil, err
+	}
+	l.Domain, l.Key, l.Clicks = link.Domain, link.Key, link.Clicks
+	m.unindex(link)
+	*link = l
+	m.index(link)
+	return &l, nil
+}
+
+func (m *MemoryStore) Delete(domain, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := linkID(domain, key)
+	link, exists := m.shortToLong[id]
+	if !exists {
+		return ErrNotFound
+	}
+	m.unindex(link)
+	delete(m.shortToLong, id)
+	return nil
+}
+
+func (m *MemoryStore) List(domain, owner, after string, limit int) ([]*Link, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	links := make([]*Link, 0)
+	for _, link := range m.shortToLong {
+		if link.Domain != domain || link.Key <= after || (owner != "" && link.Owner != owner) {
+			continue
+		}
+		l := *link
+		links = append(links, &l)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Key < links[j].Key })
+	if len(links) > limit {
+		links = links[:limit]
+	}
+	return links, nil
+}
+
+// Walk snapshots the keys only and looks every link up again, so a walk over
+// millions of links neither copies them all nor keeps the lock.
+func (m *MemoryStore) Walk(fn func(*Link) error) error {
+	type ref struct{ domain, key string }
+	m.mu.RLock()
+	refs := make([]ref, 0, len(m.shortToLong))
+	for _, link := range m.shortToLong {
+		refs = append(refs, ref{link.Domain, link.Key})
+	}
+	m.mu.RUnlock()
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].domain != refs[j].domain {
+			return refs[i].domain < refs[j].domain
+		}
+		return refs[i].key < refs[j].key
+	})
+
+	for _, r := range refs {
+		l, err := m.Get(r.domain, r.key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Hit(domain, key string, now time.Time) (*Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, exists := m.shortToLong[linkID(domain, key)]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	if err := followable(link, now); err != nil {
+		return nil, err
+	}
+	link.Clicks++
+	l := *link
+	return &l, nil
+}
+
+// checkHit returns the error Hit would, without counting a click.
+func (m *MemoryStore) checkHit(domain, key string, now time.Time) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	link, exists := m.shortToLong[linkID(domain, key)]
+	if !exists {
+		return ErrNotFound
+	}
+	return followable(link, now)
+}
+
+func followable(link *Link, now time.Time) error {
+	if link.Disabled {
+		return ErrLinkDisabled
+	}
+	if link.Dead(now) {
+		return ErrLinkGone
+	}
+	return nil
+}
+
+func (m *MemoryStore) PurgeDead(now time.Time) ([]*Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged []*Link
+	for id, link := range m.shortToLong {
+		if link.Dead(now) {
+			m.unindex(link)
+			delete(m.shortToLong, id)
+			purged = append(purged, link)
+		}
+	}
+	return purged, nil
+}
+
+// deadLinks lists the links PurgeDead would remove.
+func (m *MemoryStore) deadLinks(now time.Time) []*Link {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var links []*Link
+	for _, link := range m.shortToLong {
+		if link.Dead(now) {
+			l := *link
+			links = append(links, &l)
+		}
+	}
+	return links
+}
+
+func (m *MemoryStore) addClick(domain, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if link, exists := m.shortToLong[linkID(domain, key)]; exists {
+		link.Clicks++
+	}
+}
+
+func (m *MemoryStore) Count() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.shortToLong), nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
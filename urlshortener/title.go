@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	maxTitleBody   = 64 << 10 // only the head of a page is read
+	maxTitleLength = 200
+	maxTitleCache  = 10000
+)
+
+// TitleFetcher looks up a human readable title for a destination URL. The
+// preview page uses it; tests can swap in a stub.
+type TitleFetcher interface {
+	Title(ctx context.Context, url string) (string, error)
+}
+
+var titleRe = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// HTTPTitleFetcher reads the <title> of HTML pages. It refuses to connect to
+// loopback, private and link-local addresses so previews cannot be used to
+// probe the network the shortener runs in.
+type HTTPTitleFetcher struct {
+	client *http.Client
+}
+
+func NewHTTPTitleFetcher(timeout time.Duration) *HTTPTitleFetcher {
+	dialer := &net.Dialer{Timeout: timeout, Control: denyInternal}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+	}
+	return &HTTPTitleFetcher{client: &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}}
+}
+
+// denyInternal runs after DNS resolution, so it also catches public names
+// that resolve to internal addresses.
+func denyInternal(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("refusing to fetch from %s", host)
+	}
+	return nil
+}
+
+func (f *HTTPTitleFetcher) Title(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "urlshortener-preview/1.0")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("destination answered %s", resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return "", nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTitleBody))
+	if err != nil {
+		return "", err
+	}
+	m := titleRe.FindSubmatch(body)
+	if m == nil {
+		return "", nil
+	}
+	title := strings.Join(strings.Fields(html.UnescapeString(string(m[1]))), " ")
+	if r := []rune(title); len(r) > maxTitleLength {
+		title = string(r[:maxTitleLength]) + "…"
+	}
+	return title, nil
+}
+
+type cachedTitle struct {
+	title     string
+	expiresAt time.Time
+}
+
+// CachingTitleFetcher remembers titles, and failures as empty titles, so a
+// popular preview does not hit the destination on every view.
+type CachingTitleFetcher struct {
+	fetcher TitleFetcher
+	ttl     time.Duration
+	titles  map[string]cachedTitle
+	mu      sync.Mutex
+}
+
+func NewCachingTitleFetcher(fetcher TitleFetcher, ttl time.Duration) *CachingTitleFetcher {
+	return &CachingTitleFetcher{
+		fetcher: fetcher,
+		ttl:     ttl,
+		titles:  make(map[string]cachedTitle),
+	}
+}
+
+func (c *CachingTitleFetcher) Title(ctx context.Context, url string) (string, error) {
+	c.mu.Lock()
+	t, ok := c.titles[url]
+	c.mu.Unlock()
+	if ok && time.Now().Before(t.expiresAt) {
+		return t.title, nil
+	}
+
+	title, err := c.fetcher.Title(ctx, url)
+	if ctx.Err() != nil {
+		// The viewer went away; that says nothing about the destination.
+		return title, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The cache only has to stay bounded; starting over is good enough.
+	if len(c.titles) >= maxTitleCache {
+		clear(c.titles)
+	}
+	c.titles[url] = cachedTitle{title: title, expiresAt: time.Now().Add(c.ttl)}
+	return title, err
+}
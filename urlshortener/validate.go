@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const maxURLLength = 2048
+
+var ErrURLBlocked = errors.New("url is blocked")
+
+var allowedSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+}
+
+// normalizeURL validates a destination URL and returns it in canonical form:
+// lower case scheme and host, default ports dropped. selfHost is the host the
+// shortener is served on; pointing a link back at it would create a redirect
+// loop.
+func normalizeURL(raw, selfHost string) (*url.URL, error) {
+	raw = strings.TrimSpace(raw)
+	if len(raw) > maxURLLength {
+		return nil, fmt.Errorf("%w: url must be at most %d characters", ErrInvalidRequest, maxURLLength)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: url is not valid", ErrInvalidRequest)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if !allowedSchemes[u.Scheme] {
+		return nil, fmt.Errorf("%w: url must be an absolute http or https URL", ErrInvalidRequest)
+	}
+	if u.Host == "" || u.Opaque != "" {
+		return nil, fmt.Errorf("%w: url must include a host", ErrInvalidRequest)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("%w: url must not contain credentials", ErrInvalidRequest)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	u.Host = host
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	if selfHost != "" && sameHost(u.Host, selfHost) {
+		return nil, fmt.Errorf("%w: url must not point back at the shortener", ErrInvalidRequest)
+	}
+	return u, nil
+}
+
+// checkURL normalizes raw and runs it through the blocklist.
+func (us *UrlShortener) checkURL(raw, selfHost string) (string, error) {
+	u, err := normalizeURL(raw, selfHost)
+	if err != nil {
+		return "", err
+	}
+	if us.domains.Serves(u.Host) {
+		return "", fmt.Errorf("%w: url must not point back at the shortener", ErrInvalidRequest)
+	}
+	if reason, blocked := us.blocklist.Blocked(u); blocked {
+		return "", fmt.Errorf("%w: %s", ErrURLBlocked, reason)
+	}
+	return u.String(), nil
+}
+
+func sameHost(a, b string) bool {
+	return strings.EqualFold(hostname(a), hostname(b))
+}
+
+// Blocklist decides whether a destination may be shortened. Blocked returns
+// the reason a URL was rejected.
+type Blocklist interface {
+	Blocked(u *url.URL) (string, bool)
+}
+
+// RuleBlocklist blocks whole domains (including their subdomains) and URLs
+// matching regular expressions.
+type RuleBlocklist struct {
+	domains  map[string]bool
+	patterns []*regexp.Regexp
+	mu       sync.RWMutex
+}
+
+func NewRuleBlocklist() *RuleBlocklist {
+	return &RuleBlocklist{
+		domains: make(map[string]bool),
+	}
+}
+
+// LoadBlocklist reads one rule per line. A line is either a domain or
+// "regex:" followed by a pattern matched against the full URL; blank lines and
+// lines starting with '#' are ignored.
+func LoadBlocklist(path string) (*RuleBlocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open blocklist: %w", err)
+	}
+	defer f.Close()
+
+	bl := NewRuleBlocklist()
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		rule := strings.TrimSpace(scanner.Text())
+		if rule == "" || strings.HasPrefix(rule, "#") {
+			continue
+		}
+		if pattern, ok := strings.CutPrefix(rule, "regex:"); ok {
+			if err := bl.AddPattern(pattern); err != nil {
+				return nil, fmt.Errorf("blocklist line %d: %w", line, err)
+			}
+			continue
+		}
+		bl.AddDomain(rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read blocklist: %w", err)
+	}
+	return bl, nil
+}
+
+func (bl *RuleBlocklist) AddDomain(domain string) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.domains[strings.ToLower(strings.TrimSuffix(domain, "."))] = true
+}
+
+func (bl *RuleBlocklist) AddPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.patterns = append(bl.patterns, re)
+	return nil
+}
+
+func (bl *RuleBlocklist) Blocked(u *url.URL) (string, bool) {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	// Walk up the labels so blocking example.com also blocks a.example.com.
+	host := strings.ToLower(u.Hostname())
+	for host != "" {
+		if bl.domains[host] {
+			return "domain " + host + " is blocked", true
+		}
+		_, rest, found := strings.Cut(host, ".")
+		if !found {
+			break
+		}
+		host = rest
+	}
+
+	s := u.String()
+	for _, re := range bl.patterns {
+		if re.MatchString(s) {
+			return "url matches a blocked pattern", true
+		}
+	}
+	return "", false
+}